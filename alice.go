@@ -3,13 +3,11 @@ package alice
 // File contains global settings Alice uses
 
 import (
-	"os"
-
-	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"sync/atomic"
 )
 
-var logLevel zerolog.Level = zerolog.TraceLevel
+// logLevel is the minimum level of the messages logged by brokers without a level of their own, accessed atomically
+var logLevel int32 = int32(TraceLevel)
 
 /*
 SetLogLevel sets the level of logging Alice uses
@@ -22,13 +20,17 @@ Levels are:
 	3 Error
 	4 Fatal
 	5 Panic
+Messages below the level are not passed to the logger, the logger itself and any global logging state are left untouched
+The level applies to brokers created afterwards whose config has no level of its own, see ConnectionConfig.SetLogLevel
 */
 func SetLogLevel(level int) {
 	if level == -2 {
-		logLevel = zerolog.Disabled
-		return
+		level = int(OffLevel)
 	}
-	logLevel = zerolog.Level(level)
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// defaultLogLevel returns the level set with SetLogLevel
+func defaultLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logLevel))
 }
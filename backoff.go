@@ -0,0 +1,131 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ErrReconnectAttemptsExhausted is returned once the backoff strategy gives up on (re)connecting
+var ErrReconnectAttemptsExhausted = errors.New("reconnect attempts exhausted")
+
+// BackoffStrategy determines the delay before each (re)connection attempt
+type BackoffStrategy interface {
+	// NextDelay returns the delay before the given attempt, starting at 1, and false if no further attempts should be made
+	// elapsed is the time since the first attempt
+	NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// Backoff is a BackoffStrategy with a constant or exponentially growing delay, optional jitter and limits
+type Backoff struct {
+	initialDelay time.Duration // Delay before the first attempt
+	multiplier   float64       // Factor the delay grows with every attempt, 1 for a constant delay
+	maxDelay     time.Duration // Upper bound of the delay, 0 means unbounded
+	jitter       float64       // Fraction the delay is randomly increased or decreased by, between 0 and 1
+	maxAttempts  int           // Maximum number of attempts, 0 means unlimited
+	maxElapsed   time.Duration // Maximum time spent attempting, 0 means unlimited
+}
+
+// CreateConstantBackoff creates a backoff strategy which waits the same delay before every attempt
+func CreateConstantBackoff(delay time.Duration) *Backoff {
+	return CreateExponentialBackoff(delay, 1, 0)
+}
+
+// CreateExponentialBackoff creates a backoff strategy whose delay is multiplied by multiplier after every attempt, up to maxDelay (0 for no limit)
+func CreateExponentialBackoff(initialDelay time.Duration, multiplier float64, maxDelay time.Duration) *Backoff {
+	return &Backoff{
+		initialDelay: initialDelay,
+		multiplier:   multiplier,
+		maxDelay:     maxDelay,
+	}
+}
+
+// SetJitter sets the fraction (0 to 1) every delay is randomly increased or decreased by, so clients do not reconnect in lockstep
+func (b *Backoff) SetJitter(jitter float64) {
+	b.jitter = jitter
+}
+
+// SetMaxAttempts sets the maximum number of attempts, 0 means unlimited
+func (b *Backoff) SetMaxAttempts(maxAttempts int) {
+	b.maxAttempts = maxAttempts
+}
+
+// SetMaxElapsedTime sets the maximum time spent attempting, 0 means unlimited
+func (b *Backoff) SetMaxElapsedTime(maxElapsed time.Duration) {
+	b.maxElapsed = maxElapsed
+}
+
+// NextDelay returns the delay before the given attempt and false once the attempts or the elapsed time are exhausted
+func (b *Backoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if b.maxAttempts > 0 && attempt > b.maxAttempts {
+		return 0, false
+	}
+	if b.maxElapsed > 0 && elapsed >= b.maxElapsed {
+		return 0, false
+	}
+
+	// Without a maximum the delay is still bounded by the largest Duration, so it cannot overflow
+	maxDelay := b.maxDelay
+	if maxDelay <= 0 {
+		maxDelay = math.MaxInt64
+	}
+
+	delay := float64(b.initialDelay)
+	for i := 1; i < attempt; i++ {
+		delay *= b.multiplier
+		if delay >= float64(maxDelay) {
+			break
+		}
+	}
+
+	if b.jitter > 0 {
+		delay *= 1 - b.jitter + rand.Float64()*2*b.jitter
+	}
+
+	if delay >= float64(maxDelay) {
+		return maxDelay, true
+	}
+
+	return time.Duration(delay), true
+}
+
+/*
+retryWithBackoff calls attempt until it succeeds, waiting before every attempt as the backoff strategy dictates
+	ctx: context.Context, stops retrying once done
+	strategy: BackoffStrategy, determines the delays and when to give up
+	immediate: bool, whether to make the first attempt without waiting
+	attempt: func(int) error, the attempt to make, called with the attempt number
+	Returns nil on success, the context error or ErrReconnectAttemptsExhausted wrapping the last error
+*/
+func retryWithBackoff(ctx context.Context, strategy BackoffStrategy, immediate bool, attempt func(int) error) error {
+	start := time.Now()
+
+	var lastErr error
+	for n := 1; ; n++ {
+		delay, ok := strategy.NextDelay(n, time.Since(start))
+		if !ok {
+			if lastErr == nil {
+				return ErrReconnectAttemptsExhausted
+			}
+			return fmt.Errorf("%w: %v", ErrReconnectAttemptsExhausted, lastErr)
+		}
+
+		if n > 1 || !immediate {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+
+		lastErr = attempt(n)
+		if lastErr == nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffNextDelay(t *testing.T) {
+	backoff := CreateExponentialBackoff(time.Second, 2, time.Second*5)
+	backoff.SetMaxAttempts(5)
+
+	expected := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5}
+	for i, want := range expected {
+		delay, ok := backoff.NextDelay(i+1, 0)
+		if !ok || delay != want {
+			t.Errorf("attempt %d: delay = %s, %t, want %s", i+1, delay, ok, want)
+		}
+	}
+
+	if _, ok := backoff.NextDelay(6, 0); ok {
+		t.Error("expected the attempts to be exhausted")
+	}
+}
+
+func TestBackoffUnboundedOverflow(t *testing.T) {
+	backoff := CreateExponentialBackoff(time.Second, 2, 0)
+
+	// Without a maximum the delay keeps growing until it reaches the largest Duration
+	for _, attempt := range []int{64, 100, 10000} {
+		delay, ok := backoff.NextDelay(attempt, 0)
+		if !ok || delay != math.MaxInt64 {
+			t.Errorf("attempt %d: delay = %s, %t, want %s", attempt, delay, ok, time.Duration(math.MaxInt64))
+		}
+	}
+
+	backoff.SetJitter(0.5)
+	if delay, _ := backoff.NextDelay(100, 0); delay <= 0 {
+		t.Errorf("delay = %s, want a positive delay", delay)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	backoff := CreateConstantBackoff(time.Second)
+	backoff.SetJitter(0.5)
+
+	for i := 0; i < 100; i++ {
+		delay, _ := backoff.NextDelay(1, 0)
+		if delay < time.Second/2 || delay > time.Second*3/2 {
+			t.Fatalf("delay = %s, want between 500ms and 1.5s", delay)
+		}
+	}
+}
+
+func TestBackoffMaxElapsedTime(t *testing.T) {
+	backoff := CreateConstantBackoff(time.Second)
+	backoff.SetMaxElapsedTime(time.Minute)
+
+	if _, ok := backoff.NextDelay(100, time.Second*59); !ok {
+		t.Error("expected another attempt")
+	}
+	if _, ok := backoff.NextDelay(100, time.Minute); ok {
+		t.Error("expected the elapsed time to be exhausted")
+	}
+}
+
+func TestRetryWithBackoffExhausted(t *testing.T) {
+	backoff := CreateConstantBackoff(time.Millisecond)
+	backoff.SetMaxAttempts(3)
+
+	dialErr := errors.New("connection refused")
+	attempts := 0
+	err := retryWithBackoff(context.Background(), backoff, true, func(attempt int) error {
+		attempts = attempt
+		return dialErr
+	})
+
+	if !errors.Is(err, ErrReconnectAttemptsExhausted) {
+		t.Errorf("err = %v, want ErrReconnectAttemptsExhausted", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
@@ -0,0 +1,84 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNilMessage is returned for a nil message in a batch, or when the publish middleware passes on a nil message
+var ErrNilMessage = errors.New("message is nil")
+
+// BatchFailure is a message of a batch which failed to publish
+type BatchFailure struct {
+	Index   int      // The index of the message in the batch
+	Message *Message // The message which failed
+	Err     error    // Why the message failed, e.g. ErrNacked, ErrUnroutable, ErrNilMessage or the context error
+}
+
+// BatchError reports the messages of a batch which failed to publish, the other messages were published successfully
+type BatchError struct {
+	Total    int            // The number of messages in the batch
+	Failures []BatchFailure // The messages which failed, in the order of the batch
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d messages failed to publish, first error: %v", len(e.Failures), e.Total, e.Failures[0].Err)
+}
+
+// Messages returns the messages which failed to publish, e.g. to retry them
+func (e *BatchError) Messages() []*Message {
+	messages := make([]*Message, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		messages = append(messages, failure.Message)
+	}
+	return messages
+}
+
+/*
+publishBatch publishes every message of a batch before waiting for their confirmations
+	ctx: context.Context, bounds the publishes and the wait for their confirmations
+	messages: []*Message, the messages to publish
+	publish: PublishFunc, publishes a single message, returning its confirmation when in confirm mode
+	Returns a *BatchError if any message failed
+*/
+func publishBatch(ctx context.Context, messages []*Message, publish PublishFunc) error {
+	var failures []BatchFailure
+	confirmations := make([]*Confirmation, len(messages))
+
+	// Publish all messages first, so the broker confirms them while the rest is published
+	for i, message := range messages {
+		if message == nil {
+			failures = append(failures, BatchFailure{Index: i, Err: ErrNilMessage})
+			continue
+		}
+
+		confirmation, err := publish(ctx, message)
+		if err != nil {
+			failures = append(failures, BatchFailure{Index: i, Message: message, Err: err})
+			continue
+		}
+		confirmations[i] = confirmation
+	}
+
+	// Wait for the confirmations, in confirm mode
+	for i, confirmation := range confirmations {
+		if confirmation == nil {
+			continue
+		}
+		if err := confirmation.Wait(ctx); err != nil {
+			failures = append(failures, BatchFailure{Index: i, Message: messages[i], Err: err})
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	// Keep the failures in the order of the batch
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Index < failures[j].Index
+	})
+	return &BatchError{Total: len(messages), Failures: failures}
+}
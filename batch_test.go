@@ -0,0 +1,102 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPublishBatchFailures(t *testing.T) {
+	messages := []*Message{
+		{Body: []byte("nacked"), RoutingKey: "key"},
+		{Body: []byte("acked"), RoutingKey: "key"},
+		{Body: []byte("failed"), RoutingKey: "key"},
+	}
+
+	failed := errors.New("channel unavailable")
+	confirms := newConfirmTracker(nil)
+	err := publishBatch(context.Background(), messages, func(ctx context.Context, message *Message) (*Confirmation, error) {
+		if string(message.Body) == "failed" {
+			return nil, failed
+		}
+
+		confirmation := confirms.add(message.RoutingKey, "")
+		go confirms.confirm(amqp.Confirmation{DeliveryTag: confirmation.DeliveryTag(), Ack: string(message.Body) == "acked"})
+		return confirmation, nil
+	})
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("err = %v, want a BatchError", err)
+	}
+	if batchErr.Total != 3 || len(batchErr.Failures) != 2 {
+		t.Fatalf("batch error = %v", batchErr)
+	}
+
+	nacked, publishFailed := batchErr.Failures[0], batchErr.Failures[1]
+	if nacked.Index != 0 || nacked.Err != ErrNacked {
+		t.Errorf("first failure = %+v, want index 0 with %v", nacked, ErrNacked)
+	}
+	if publishFailed.Index != 2 || publishFailed.Err != failed {
+		t.Errorf("second failure = %+v, want index 2 with %v", publishFailed, failed)
+	}
+	if retry := batchErr.Messages(); len(retry) != 2 || retry[0] != messages[0] || retry[1] != messages[2] {
+		t.Errorf("messages to retry = %v", retry)
+	}
+}
+
+func TestPublishBatchNilMessage(t *testing.T) {
+	messages := []*Message{nil, {Body: []byte("published"), RoutingKey: "key"}}
+
+	// A nil message fails on its own, the rest of the batch is still published
+	published := 0
+	err := publishBatch(context.Background(), messages, func(ctx context.Context, message *Message) (*Confirmation, error) {
+		published++
+		return nil, nil
+	})
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("err = %v, want a BatchError", err)
+	}
+	if len(batchErr.Failures) != 1 || batchErr.Failures[0].Index != 0 || batchErr.Failures[0].Err != ErrNilMessage {
+		t.Errorf("failures = %+v, want index 0 with %v", batchErr.Failures, ErrNilMessage)
+	}
+	if published != 1 {
+		t.Errorf("published %d messages, want 1", published)
+	}
+
+	// The producer rejects nil messages passed on by the publish middleware
+	p := newTestProducer(t, nil)
+	if _, err := p.publishMessage(context.Background(), nil); err != ErrNilMessage {
+		t.Errorf("err = %v, want %v", err, ErrNilMessage)
+	}
+}
+
+func TestMockPublishBatch(t *testing.T) {
+	broker := CreateMockBroker()
+	exchange, _ := CreateExchange("test-exchange", Direct, false, true, false, false, nil)
+	queue := CreateQueue(exchange, "test-queue", false, false, true, false, nil)
+
+	c, _ := broker.CreateConsumer(queue, "key", "")
+	p, _ := broker.CreateProducer(exchange)
+
+	received := make(chan string, 2)
+	go c.Consume(nil, func(ctx context.Context, delivery amqp.Delivery) error {
+		received <- string(delivery.Body)
+		return nil
+	})
+
+	err := p.PublishBatch(context.Background(), []*Message{
+		{Body: []byte("first"), RoutingKey: "key"},
+		{Body: []byte("second"), RoutingKey: "key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, second := <-received, <-received; first+second != "firstsecond" && first+second != "secondfirst" {
+		t.Errorf("received %q and %q", first, second)
+	}
+}
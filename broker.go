@@ -1,99 +1,91 @@
 package alice
 
 import (
-	"fmt"
-	"time"
+	"context"
+	"errors"
+	"sync"
 
-	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
 )
 
+// ErrBrokerShutdown is returned when using a broker which has been shut down
+var ErrBrokerShutdown = errors.New("broker has been shut down")
+
 // A RabbitBroker implements the Broker interface
 type RabbitBroker struct {
 	config       *ConnectionConfig // The config for the connection
+	dials        uint32            // Number of connection attempts, used to distribute connections over the nodes
+	log          Logger            // The logger of the broker
+	events       *eventBus         // The bus the broker's events are emitted on
+	mu           sync.Mutex        // Guards the fields below
 	consumerConn *connection       // Dedicated connection for consumers
 	producerConn *connection       // Dedicated connection for producers
+	consumers    []*RabbitConsumer // The consumers created by this broker
+	producers    []*RabbitProducer // The producers created by this broker
+	closed       bool              // Whether the broker has been shut down
 }
 
 /*
 CreateBroker creates a broker
 	config: *ConnectionConfig, the connection configuration that should be used to connect to the broker
-	Returns Broker and a possible error
+	With auto reconnect turned on, connecting is retried according to the backoff strategy of the config
+	Returns Broker and a possible error, ErrReconnectAttemptsExhausted once the backoff strategy gives up
 */
 func CreateBroker(config *ConnectionConfig) (Broker, error) {
+	return CreateBrokerWithContext(context.Background(), config)
+}
+
+/*
+CreateBrokerWithContext creates a broker, giving up once the context is done
+	ctx: context.Context, bounds the time spent connecting, including the reconnection attempts
+	config: *ConnectionConfig, the connection configuration that should be used to connect to the broker
+	With auto reconnect turned on, connecting is retried according to the backoff strategy of the config
+	Returns Broker and a possible error, the context's error once it is done
+*/
+func CreateBrokerWithContext(ctx context.Context, config *ConnectionConfig) (Broker, error) {
+	logger := config.logger()
 	broker := RabbitBroker{
 		config: config,
+		log:    logger,
+		events: newEventBus(logger),
 	}
 
-	log.Info().Msg("creating broker")
-
-	attemptNumber := 1
-
-	// Check if reconnect is turned on
-	if config.autoReconnect {
-		// Create a ticker with the reconnect delay
-		ticker := time.NewTicker(config.reconnectDelay)
-
-		// Create done channel (for when the connection is successfully established)
-		done := make(chan bool, 1)
-
-		log.Info().Msg("attempting RabbitMQ connection")
-
-		// Attempt to connect to the broker
-		conn, err := broker.connect()
-
-		// If there is no error
-		if err == nil {
-			// Close the connection for now
-			conn.conn.Close()
-
-			// Stop the ticker
-			ticker.Stop()
+	broker.log.Log(InfoLevel, "creating broker")
 
-			// Signal that we are done
-			done <- true
-		} else {
-			// There is an error
-			log.Error().Err(err).Int("attempt", attemptNumber).Msg("error while connecting to RabbitMQ")
+	// Test connection
+	if !config.autoReconnect {
+		conn, err := broker.connect(ctx, "")
+		if err != nil {
+			return nil, err
 		}
 
-		for {
-			select {
-			case <-ticker.C:
-				log.Info().Msg("attempting RabbitMQ connection")
-
-				// Attempt to connect to the broker
-				conn, err := broker.connect()
-
-				// If there is no error
-				if err == nil {
-					// Close the connection for now
-					conn.conn.Close()
-
-					// Stop the ticker
-					ticker.Stop()
+		// Close connection as it is not needed right now
+		conn.shutdown()
+		return &broker, nil
+	}
 
-					// Signal that we are done
-					done <- true
-				}
+	var attempts int
+	err := retryWithBackoff(ctx, config.reconnectBackoff(), true, func(attempt int) error {
+		attempts = attempt
+		broker.log.Log(InfoLevel, "attempting RabbitMQ connection", "attempt", attempt)
 
-				attemptNumber++
-			case <-done:
-				log.Info().Int("attempt", attemptNumber).Msg("successfully connected to RabbitMQ")
-				return &broker, nil
-			}
-		}
-	} else {
-		// Test connection
-		conn, err := broker.connect()
+		// Attempt to connect to the broker
+		conn, err := broker.connect(ctx, "")
 		if err != nil {
-			return nil, err
+			broker.log.Log(ErrorLevel, "error while connecting to RabbitMQ", "err", err, "attempt", attempt)
+			return err
 		}
 
-		// Close connection as it is not needed right now
-		conn.conn.Close()
-		return &broker, nil
+		// Close the connection for now
+		conn.shutdown()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	broker.log.Log(InfoLevel, "successfully connected to RabbitMQ", "attempt", attempts)
+	return &broker, nil
 }
 
 /*
@@ -104,12 +96,43 @@ CreateConsumer creates a consumer
 	Returns: Consumer and a possible error
 */
 func (b *RabbitBroker) CreateConsumer(queue *Queue, bindingKey string, consumerTag string) (Consumer, error) {
+	return b.CreateConsumerWithConfig(queue, bindingKey, consumerTag, DefaultConsumerConfig)
+}
+
+/*
+CreateConsumerWithConfig creates a consumer using the given consumer configuration
+	queue: *Queue, the queue this consumer should bind to
+	bindingKey: string, the key with which this consumer binds to the queue
+	consumerTag: string, the tag identifying this consumer
+	config: *ConsumerConfig, the configuration of the consumer
+	Returns: Consumer and a possible error
+*/
+func (b *RabbitBroker) CreateConsumerWithConfig(queue *Queue, bindingKey string, consumerTag string, config *ConsumerConfig) (Consumer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBrokerShutdown
+	}
+
 	if b.consumerConn == nil {
-		b.consumerConn, _ = b.connect()
-		go b.consumerConn.reconnect("consumer", b.consumerConn.conn.NotifyClose(make(chan *amqp.Error)))
+		conn, err := b.connect(context.Background(), "consumer")
+		if err != nil {
+			return nil, err
+		}
+		conn.listenForBlocked("consumer", conn.conn)
+		go conn.reconnect("consumer", conn.conn.NotifyClose(make(chan *amqp.Error)))
+		b.events.emit(Event{Type: Connected, ConnType: "consumer", Node: conn.currentNode()})
+		b.consumerConn = conn
+	}
+
+	consumer, err := b.consumerConn.createConsumer(queue, bindingKey, consumerTag, config)
+	if err != nil {
+		return nil, err
 	}
 
-	return b.consumerConn.createConsumer(queue, bindingKey, consumerTag)
+	b.consumers = append(b.consumers, consumer)
+	return consumer, nil
 }
 
 /*
@@ -119,45 +142,167 @@ CreateProducer creates a producer
 	Returns: Producer and a possible error
 */
 func (b *RabbitBroker) CreateProducer(exchange *Exchange) (Producer, error) {
+	return b.CreateProducerWithConfig(exchange, DefaultProducerConfig)
+}
+
+/*
+CreateProducerWithConfig creates a producer using the given producer configuration
+	exchange: *Exchange, the exchange this producer will produce to
+	config: *ProducerConfig, the configuration of the producer
+	Returns: Producer and a possible error
+*/
+func (b *RabbitBroker) CreateProducerWithConfig(exchange *Exchange, config *ProducerConfig) (Producer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBrokerShutdown
+	}
+
 	if b.producerConn == nil {
-		b.producerConn, _ = b.connect()
-		go b.producerConn.reconnect("producer", b.producerConn.conn.NotifyClose(make(chan *amqp.Error)))
+		conn, err := b.connect(context.Background(), "producer")
+		if err != nil {
+			return nil, err
+		}
+		conn.listenForBlocked("producer", conn.conn)
+		go conn.reconnect("producer", conn.conn.NotifyClose(make(chan *amqp.Error)))
+		b.events.emit(Event{Type: Connected, ConnType: "producer", Node: conn.currentNode()})
+		b.producerConn = conn
+	}
+
+	producer, err := b.producerConn.createProducer(exchange, config)
+	if err != nil {
+		return nil, err
 	}
 
-	return b.producerConn.createProducer(exchange)
+	b.producers = append(b.producers, producer)
+	return producer, nil
 }
 
-// Connect attempts to make a connection to the broker using the broker connection config
-func (b *RabbitBroker) connect() (*connection, error) {
-	var err error
+/*
+Subscribe subscribes to the broker's connection and channel state events
+	types: ...EventType, the event types to subscribe to, all types when none are given
+	Returns a Subscription delivering the events, events are dropped when the subscriber falls behind
+*/
+func (b *RabbitBroker) Subscribe(types ...EventType) *Subscription {
+	return b.events.subscribe(types...)
+}
+
+/*
+Shutdown gracefully shuts down the broker
+	ctx: context.Context, the deadline for draining the consumers and producers
+	The consumers stop receiving messages and the running message handlers finish and acknowledge their messages,
+	then the producers stop publishing and their outstanding confirmations are awaited.
+	Finally all channels and both connections are closed and reconnecting stops
+	Returns the context's error if draining did not finish in time, the channels and connections are closed regardless
+*/
+func (b *RabbitBroker) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	consumers := b.consumers
+	producers := b.producers
+	conns := []*connection{b.consumerConn, b.producerConn}
+	b.mu.Unlock()
+
+	b.log.Log(InfoLevel, "shutting down broker")
+
+	var firstErr error
+
+	// Drain the consumers first, their handlers might still be publishing
+	for _, consumer := range consumers {
+		err := consumer.drain(ctx)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, producer := range producers {
+		err := producer.drain(ctx)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
 
+	for _, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		err := conn.shutdown()
+		if err != nil && err != amqp.ErrClosed && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	b.log.Log(InfoLevel, "shut down broker")
+
+	return firstErr
+}
+
+// Connect attempts to make a connection to the broker using the broker connection config
+// connType is either "consumer" or "producer", or empty for a test connection
+// Returns the context's error if it is done before the connection is established
+func (b *RabbitBroker) connect(ctx context.Context, connType string) (*connection, error) {
 	// Get the connection config from the broker
 	config := *b.config
 
 	// Create a connection struct
-	connection := &connection{
-		conn:   nil,
-		config: config,
-	}
+	connection := newConnection(config, &b.dials, b.events)
 
-	// Form the RabbitMQ connection URI
-	amqpURI := "amqp://" + config.user + ":" + config.password + "@" + config.host + ":" + fmt.Sprint(config.port)
-
-	// Create a buffered done channel to fill when connection is established
+	// Create a buffered done channel to fill when connection is established, so the dial never blocks on it
 	done := make(chan error, 1)
 
 	// Go create a connection
 	go func() {
 		// Attempt to dial up RabbitMQ
-		connection.conn, err = amqp.Dial(amqpURI)
+		conn, node, err := connection.dial(connType)
+		if err == nil {
+			err = connection.setConn(conn, node)
+		}
 
 		// Once AMQP dial has completed, pass a possible error into the done channel
 		done <- err
 	}()
-	err = <-done
-	if err != nil {
-		return nil, err
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		// Close the connection once the dial completes, nobody is waiting for it anymore
+		go func() {
+			if <-done == nil {
+				connection.shutdown()
+			}
+		}()
+		return nil, ctx.Err()
 	}
 
 	return connection, nil
 }
+
+// ConsumerNode returns the address of the node the consumer connection is connected to, empty if there is no consumer connection
+func (b *RabbitBroker) ConsumerNode() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.consumerConn == nil {
+		return ""
+	}
+	return b.consumerConn.currentNode()
+}
+
+// ProducerNode returns the address of the node the producer connection is connected to, empty if there is no producer connection
+func (b *RabbitBroker) ProducerNode() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.producerConn == nil {
+		return ""
+	}
+	return b.producerConn.currentNode()
+}
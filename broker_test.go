@@ -1,8 +1,14 @@
 package alice
 
 import (
+	"context"
+	"errors"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
 )
 
 // broker used during tests
@@ -14,3 +20,73 @@ func TestMain(m *testing.M) {
 	exit := m.Run()
 	os.Exit(exit)
 }
+
+func TestCreateBrokerWithContextDeadline(t *testing.T) {
+	// Nothing listens on this port, so every attempt fails
+	config := CreateConfig("guest", "guest", "127.0.0.1", 1, true, time.Millisecond*10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err := CreateBrokerWithContext(ctx, config)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestBrokerShutdown(t *testing.T) {
+	b, err := CreateBroker(DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "key"
+	exchange, _ := CreateExchange("test-shutdown-exchange", Direct, false, true, false, false, nil)
+	queue := CreateQueue(exchange, "test-shutdown-queue", false, true, false, false, nil)
+
+	c, err := b.CreateConsumer(queue, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler is still running when the broker shuts down
+	var started, handled int32
+	go c.Consume(nil, func(ctx context.Context, delivery amqp.Delivery) error {
+		atomic.StoreInt32(&started, 1)
+		time.Sleep(time.Millisecond * 500)
+		atomic.StoreInt32(&handled, 1)
+		return nil
+	})
+
+	config := CreateProducerConfig()
+	config.SetConfirmMode(true)
+	p, err := b.CreateProducerWithConfig(exchange, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Publish(context.Background(), []byte("shutdown"), key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for atomic.LoadInt32(&started) == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	err = b.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&handled) == 0 {
+		t.Error("expected the running handler to finish before the broker shut down")
+	}
+
+	_, err = b.CreateProducer(exchange)
+	if !errors.Is(err, ErrBrokerShutdown) {
+		t.Errorf("err = %v, want ErrBrokerShutdown", err)
+	}
+}
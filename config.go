@@ -1,21 +1,62 @@
 package alice
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strconv"
 	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// NodeSelection determines the order in which cluster nodes are tried when connecting
+type NodeSelection int
+
+const (
+	// PrioritySelection tries the nodes in the configured order, so the first healthy node is always used
+	PrioritySelection NodeSelection = iota
+
+	// RoundRobinSelection starts every connection attempt at the node after the one the previous attempt started at
+	RoundRobinSelection
+
+	// RandomSelection tries the nodes in a random order
+	RandomSelection
 )
 
 // ConnectionConfig is a config structure to use when setting up a RabbitMQ connection
 type ConnectionConfig struct {
-	user           string        // Username for connection
-	password       string        // Password for connection
-	host           string        // URI for RabbitMQ broker
-	port           int           // RabbitMQ broker port
-	autoReconnect  bool          // Whether to try to reconnect after a unexpected disconnect
-	reconnectDelay time.Duration // The delay between reconnection attempts
+	user           string           // Username for connection
+	password       string           // Password for connection
+	host           string           // URI for RabbitMQ broker
+	port           int              // RabbitMQ broker port
+	autoReconnect  bool             // Whether to try to reconnect after a unexpected disconnect
+	reconnectDelay time.Duration    // The delay between reconnection attempts
+	backoff        BackoffStrategy  // The delays between reconnection attempts, overrides reconnectDelay when set
+	tlsConfig      *tls.Config      // TLS configuration, nil for a plain amqp connection
+	externalAuth   bool             // Whether to authenticate with SASL EXTERNAL, using the TLS client certificate
+	vhost          string           // Virtual host to connect to
+	heartbeat      time.Duration    // Heartbeat interval, less than a second uses the server's interval
+	channelMax     int              // Maximum number of channels, 0 means 2^16 - 1
+	frameSize      int              // Maximum frame size in bytes, 0 means unlimited
+	locale         string           // Connection locale
+	connectionName string           // Name of the connection shown in the management UI
+	properties     amqp.Table       // Additional client properties advertised to the broker
+	nodes          []string         // Addresses ("host:port") of the cluster nodes, overrides host and port when set
+	nodeSelection  NodeSelection    // The order in which the nodes are tried
+	log            Logger           // Receives the log messages, nil for the global zerolog logger
+	logLevel       *LogLevel        // Minimum level of the messages passed to the logger, nil for the level set with SetLogLevel
+	metrics        MetricsCollector // Receives the measurements, nil for none
+	tracer         Tracer           // Traces published and consumed messages, nil for none
+
+	consumerMiddleware []Middleware        // Wraps the handlers of every consumer
+	publishMiddleware  []PublishMiddleware // Wraps the publishes of every producer
 }
 
 // DefaultConfig is the default configuration for RabbitMQ.
-//	User: "guest", password: "guest", host: "localhost", port: 5672, autoReconnect: true, reconnectDelay: time.Second * 10
+//	User: "guest", password: "guest", host: "localhost", port: 5672, autoReconnect: true, reconnectDelay: time.Second * 10, vhost: "/", heartbeat: time.Second * 10, locale: "en_US"
 var DefaultConfig = &ConnectionConfig{
 	user:           "guest",
 	password:       "guest",
@@ -23,6 +64,9 @@ var DefaultConfig = &ConnectionConfig{
 	port:           5672,
 	autoReconnect:  true,
 	reconnectDelay: time.Second * 10,
+	vhost:          "/",
+	heartbeat:      time.Second * 10,
+	locale:         "en_US",
 }
 
 // CreateConfig creates a connection configuration with the supplied parameters
@@ -34,6 +78,9 @@ func CreateConfig(user string, password string, host string, port int, autoRecon
 		port:           port,
 		autoReconnect:  autoReconnect,
 		reconnectDelay: reconnectDelay,
+		vhost:          "/",
+		heartbeat:      time.Second * 10,
+		locale:         "en_US",
 	}
 	return config
 }
@@ -67,3 +114,201 @@ func (config *ConnectionConfig) SetAutoReconnect(autoReconnect bool) {
 func (config *ConnectionConfig) SetReconnectDelay(reconnectDelay time.Duration) {
 	config.reconnectDelay = reconnectDelay
 }
+
+// SetBackoff sets the strategy determining the delays between reconnection attempts, overriding the reconnect delay
+// Once the strategy gives up, reconnecting fails with ErrReconnectAttemptsExhausted
+func (config *ConnectionConfig) SetBackoff(backoff BackoffStrategy) {
+	config.backoff = backoff
+}
+
+// reconnectBackoff returns the backoff strategy to use, a constant reconnect delay when none is set
+func (config *ConnectionConfig) reconnectBackoff() BackoffStrategy {
+	if config.backoff != nil {
+		return config.backoff
+	}
+	return CreateConstantBackoff(config.reconnectDelay)
+}
+
+// SetLogger sets the logger receiving the log messages of brokers using this configuration
+// Use CreateZerologLogger, CreateSlogLogger or CreateNopLogger to create one, by default the global zerolog logger is used
+func (config *ConnectionConfig) SetLogger(logger Logger) {
+	config.log = logger
+}
+
+// SetLogLevel sets the minimum level of the messages passed to the logger of brokers using this configuration
+// Without a level the one set with the package level SetLogLevel is used, OffLevel turns logging off
+func (config *ConnectionConfig) SetLogLevel(level LogLevel) {
+	config.logLevel = &level
+}
+
+// logger returns the logger to use, dropping the messages below the configured level
+func (config *ConnectionConfig) logger() Logger {
+	level := defaultLogLevel()
+	if config.logLevel != nil {
+		level = *config.logLevel
+	}
+	return newLogger(config.log, level)
+}
+
+// SetMetricsCollector sets the collector receiving the measurements of brokers using this configuration
+// See the prometheus subpackage for a Prometheus implementation
+func (config *ConnectionConfig) SetMetricsCollector(metrics MetricsCollector) {
+	config.metrics = metrics
+}
+
+// metricsCollector returns the collector to use, one discarding the measurements when none is set
+func (config *ConnectionConfig) metricsCollector() MetricsCollector {
+	if config.metrics != nil {
+		return config.metrics
+	}
+	return nopMetrics{}
+}
+
+// SetTracer sets the tracer starting the spans of the messages published and consumed by brokers using this configuration
+// The trace context is propagated through the message headers, see the otel subpackage for an OpenTelemetry implementation
+func (config *ConnectionConfig) SetTracer(tracer Tracer) {
+	config.tracer = tracer
+}
+
+// messageTracer returns the tracer to use, one which does not trace when none is set
+func (config *ConnectionConfig) messageTracer() Tracer {
+	if config.tracer != nil {
+		return config.tracer
+	}
+	return nopTracer{}
+}
+
+// AddConsumerMiddleware adds middleware wrapping the handlers of every consumer of brokers using this configuration
+// It applies to brokers created afterwards and runs outside of the consumer's own middleware, see Middleware
+func (config *ConnectionConfig) AddConsumerMiddleware(middleware ...Middleware) {
+	config.consumerMiddleware = append(config.consumerMiddleware, middleware...)
+}
+
+// AddPublishMiddleware adds middleware wrapping the publishes of every producer of brokers using this configuration
+// It applies to brokers created afterwards and runs outside of the producer's own middleware, see PublishMiddleware
+func (config *ConnectionConfig) AddPublishMiddleware(middleware ...PublishMiddleware) {
+	config.publishMiddleware = append(config.publishMiddleware, middleware...)
+}
+
+// SetNodes sets the addresses ("host:port") of the cluster nodes to connect to, overriding the host and port
+// Every connection attempt tries the nodes in the order of the node selection until one accepts the connection
+func (config *ConnectionConfig) SetNodes(nodes ...string) error {
+	for _, node := range nodes {
+		_, port, err := net.SplitHostPort(node)
+		if err != nil {
+			return err
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return errors.New("invalid port in node address " + node)
+		}
+	}
+
+	config.nodes = nodes
+	return nil
+}
+
+// AddNode adds a cluster node to connect to, overriding the host and port
+func (config *ConnectionConfig) AddNode(host string, port int) {
+	config.nodes = append(config.nodes, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// SetNodeSelection sets the order in which the cluster nodes are tried
+func (config *ConnectionConfig) SetNodeSelection(nodeSelection NodeSelection) {
+	config.nodeSelection = nodeSelection
+}
+
+// SetVhost sets the virtual host to connect to
+func (config *ConnectionConfig) SetVhost(vhost string) {
+	config.vhost = vhost
+}
+
+// SetHeartbeat sets the heartbeat interval, less than a second uses the interval the server proposes
+func (config *ConnectionConfig) SetHeartbeat(heartbeat time.Duration) {
+	config.heartbeat = heartbeat
+}
+
+// SetChannelMax sets the maximum number of channels on a connection, 0 means 2^16 - 1
+func (config *ConnectionConfig) SetChannelMax(channelMax int) {
+	config.channelMax = channelMax
+}
+
+// SetFrameSize sets the maximum frame size in bytes, 0 means unlimited
+func (config *ConnectionConfig) SetFrameSize(frameSize int) {
+	config.frameSize = frameSize
+}
+
+// SetLocale sets the connection locale
+func (config *ConnectionConfig) SetLocale(locale string) {
+	config.locale = locale
+}
+
+// SetConnectionName sets the connection name shown in the RabbitMQ management UI
+// The consumer and producer connections are suffixed with their type
+func (config *ConnectionConfig) SetConnectionName(connectionName string) {
+	config.connectionName = connectionName
+}
+
+// SetClientProperties sets additional client properties advertised to the broker
+func (config *ConnectionConfig) SetClientProperties(properties amqp.Table) {
+	config.properties = properties
+}
+
+// SetTLSConfig sets the TLS configuration used to connect over amqps, nil connects without TLS
+func (config *ConnectionConfig) SetTLSConfig(tlsConfig *tls.Config) {
+	config.tlsConfig = tlsConfig
+}
+
+// SetCACertificates sets the PEM encoded certificate authorities used to verify the broker, enabling TLS
+func (config *ConnectionConfig) SetCACertificates(pemCerts []byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return errors.New("no valid CA certificates found")
+	}
+
+	config.enableTLS().RootCAs = pool
+	return nil
+}
+
+// SetCAFile reads the PEM encoded CA bundle used to verify the broker from a file, enabling TLS
+func (config *ConnectionConfig) SetCAFile(caFile string) error {
+	pemCerts, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	return config.SetCACertificates(pemCerts)
+}
+
+// SetClientCertificate loads the PEM encoded client certificate and key presented to the broker, enabling TLS
+func (config *ConnectionConfig) SetClientCertificate(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	config.enableTLS().Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// SetServerName sets the name the broker certificate is verified against, enabling TLS. Defaults to the host
+func (config *ConnectionConfig) SetServerName(serverName string) {
+	config.enableTLS().ServerName = serverName
+}
+
+// SetTLSMinVersion sets the minimum TLS version, e.g. tls.VersionTLS12, enabling TLS
+func (config *ConnectionConfig) SetTLSMinVersion(version uint16) {
+	config.enableTLS().MinVersion = version
+}
+
+// SetExternalAuth sets whether to authenticate using SASL EXTERNAL instead of the user and password
+// The broker then authenticates the connection using the TLS client certificate
+func (config *ConnectionConfig) SetExternalAuth(externalAuth bool) {
+	config.externalAuth = externalAuth
+}
+
+// enableTLS returns the TLS configuration, creating it if TLS was not enabled yet
+func (config *ConnectionConfig) enableTLS() *tls.Config {
+	if config.tlsConfig == nil {
+		config.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return config.tlsConfig
+}
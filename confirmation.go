@@ -0,0 +1,198 @@
+package alice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrConfirmModeDisabled is returned when a confirmation is requested from a producer that is not in confirm mode
+	ErrConfirmModeDisabled = errors.New("producer is not in confirm mode")
+
+	// ErrNacked is returned when the broker negatively acknowledged a published message
+	ErrNacked = errors.New("message was nacked by the broker")
+
+	// ErrChannelClosed is returned when the channel closed before the operation could complete
+	ErrChannelClosed = errors.New("channel was closed")
+
+	// ErrUnroutable is returned when the broker returned a mandatory message because it could not be routed to any queue
+	ErrUnroutable = errors.New("message could not be routed to any queue")
+)
+
+// Confirmation is the pending broker acknowledgement of a single published message
+type Confirmation struct {
+	deliveryTag uint64        // Delivery tag of the message on the producer channel
+	done        chan struct{} // Closed once the broker acked or nacked the message
+	err         error         // nil if the message was acked, the reason otherwise
+	returnErr   error         // Set when the broker returned the message, the confirmation resolves with it once acked
+	messageID   string        // The message ID a mandatory message was published with, correlates a return with the confirmation
+	routingKey  string        // The routing key the message was published with
+	publishedAt time.Time     // When the message was published
+}
+
+// newConfirmation creates a pending confirmation for the given delivery tag
+func newConfirmation(deliveryTag uint64) *Confirmation {
+	return &Confirmation{
+		deliveryTag: deliveryTag,
+		done:        make(chan struct{}),
+	}
+}
+
+// DeliveryTag returns the delivery tag the message was published with
+// A message spooled during an outage, or kept in a configured spool store until confirmed, has delivery tag 0
+func (c *Confirmation) DeliveryTag() uint64 {
+	return c.deliveryTag
+}
+
+// Done returns a channel which is closed once the broker has acked or nacked the message
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+/*
+Wait blocks until the broker has acked or nacked the message, or the context is done
+	ctx: context.Context, the context bounding the wait
+	Returns nil if the message was acked, ErrNacked if it was nacked, ErrUnroutable if a mandatory message was returned,
+	ErrChannelClosed if the channel closed before a confirmation arrived or the context error
+*/
+func (c *Confirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Acked blocks until the message is confirmed and returns whether the broker acked it
+func (c *Confirmation) Acked() bool {
+	<-c.done
+	return c.err == nil
+}
+
+// resolve completes the confirmation with the given result
+func (c *Confirmation) resolve(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// confirmTracker keeps track of the unconfirmed messages on a channel in confirm mode
+type confirmTracker struct {
+	mu      sync.Mutex               // Guards the fields below
+	lastTag uint64                   // Delivery tag of the last published message
+	pending map[uint64]*Confirmation // Confirmations which are still awaiting a broker response
+	observe func(*Confirmation)      // Called with every confirmation the broker responded to, nil for none
+}
+
+// newConfirmTracker creates a tracker for a channel which was just put into confirm mode
+// observe is called with every confirmation the broker responds to, it may be nil
+func newConfirmTracker(observe func(*Confirmation)) *confirmTracker {
+	return &confirmTracker{
+		pending: make(map[uint64]*Confirmation),
+		observe: observe,
+	}
+}
+
+// add registers the next delivery tag for a message with the given routing key, must be called before the message is published
+// messageID is the message ID of a mandatory message, empty for messages the broker does not return
+func (t *confirmTracker) add(routingKey string, messageID string) *Confirmation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastTag++
+	c := newConfirmation(t.lastTag)
+	c.routingKey = routingKey
+	c.messageID = messageID
+	c.publishedAt = time.Now()
+	t.pending[c.deliveryTag] = c
+	return c
+}
+
+// remove unregisters a confirmation whose message could not be published
+func (t *confirmTracker) remove(c *Confirmation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, c.deliveryTag)
+	t.lastTag--
+}
+
+// returned marks the confirmation of a message the broker returned, it resolves with err once the broker acks the message
+// The message is looked up by its message ID, of messages published with the same ID the oldest one which was not returned yet is marked
+// The broker sends the return before the ack, so this must be called before the ack is confirmed
+func (t *confirmTracker) returned(messageID string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var oldest *Confirmation
+	for _, c := range t.pending {
+		if c.messageID != messageID || c.returnErr != nil {
+			continue
+		}
+		if oldest == nil || c.deliveryTag < oldest.deliveryTag {
+			oldest = c
+		}
+	}
+	if oldest != nil {
+		oldest.returnErr = err
+	}
+}
+
+// confirm resolves the confirmation belonging to a broker ack or nack
+func (t *confirmTracker) confirm(confirmation amqp.Confirmation) {
+	t.mu.Lock()
+	c, ok := t.pending[confirmation.DeliveryTag]
+	delete(t.pending, confirmation.DeliveryTag)
+	t.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if confirmation.Ack {
+		c.resolve(c.returnErr)
+	} else {
+		c.resolve(ErrNacked)
+	}
+
+	if t.observe != nil {
+		t.observe(c)
+	}
+}
+
+// fail resolves every pending confirmation with the given error
+func (t *confirmTracker) fail(err error) {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[uint64]*Confirmation)
+	t.mu.Unlock()
+
+	for _, c := range pending {
+		c.resolve(err)
+	}
+}
+
+// newMessageID generates a random message ID, which mandatory messages published without one are given in confirm mode
+func newMessageID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// outstanding returns the confirmations which are still awaiting a broker response
+func (t *confirmTracker) outstanding() []*Confirmation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	confirmations := make([]*Confirmation, 0, len(t.pending))
+	for _, c := range t.pending {
+		confirmations = append(confirmations, c)
+	}
+	return confirmations
+}
@@ -0,0 +1,67 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConfirmTrackerReturned(t *testing.T) {
+	confirms := newConfirmTracker(nil)
+	routed := confirms.add("routed", "routed-id")
+	unroutable := confirms.add("unroutable", "unroutable-id")
+
+	// Messages published with the same ID are returned in the order they were published
+	first := confirms.add("unroutable", "shared-id")
+	second := confirms.add("routed", "shared-id")
+
+	confirms.returned(unroutable.messageID, ErrUnroutable)
+	confirms.returned("shared-id", ErrUnroutable)
+	for _, c := range []*Confirmation{routed, unroutable, first, second} {
+		confirms.confirm(amqp.Confirmation{DeliveryTag: c.DeliveryTag(), Ack: true})
+	}
+
+	if err := routed.Wait(context.Background()); err != nil {
+		t.Errorf("routed message: err = %v, want nil", err)
+	}
+	if err := unroutable.Wait(context.Background()); err != ErrUnroutable {
+		t.Errorf("unroutable message: err = %v, want %v", err, ErrUnroutable)
+	}
+	if err := first.Wait(context.Background()); err != ErrUnroutable {
+		t.Errorf("first message with a shared ID: err = %v, want %v", err, ErrUnroutable)
+	}
+	if err := second.Wait(context.Background()); err != nil {
+		t.Errorf("second message with a shared ID: err = %v, want nil", err)
+	}
+}
+
+func TestMockPublishUnroutable(t *testing.T) {
+	broker := CreateMockBroker()
+	exchange, _ := CreateExchange("test-exchange", Direct, false, true, false, false, nil)
+
+	returned := make(chan amqp.Return, 1)
+	config := CreateProducerConfig()
+	config.SetConfirmMode(true)
+	config.SetReturnHandler(func(r amqp.Return) {
+		returned <- r
+	})
+	options := CreateDefaultPublishOptions()
+	options.SetMandatory(true)
+
+	p, _ := broker.CreateProducerWithConfig(exchange, config)
+
+	err := p.PublishWithOptions(context.Background(), []byte("lost"), "key", nil, options)
+	if !errors.Is(err, ErrUnroutable) {
+		t.Errorf("err = %v, want %v", err, ErrUnroutable)
+	}
+	if r := <-returned; r.RoutingKey != "key" || r.ReplyCode != amqp.NoRoute {
+		t.Errorf("returned = %+v", r)
+	}
+
+	// Without the mandatory flag unroutable messages are dropped
+	if err := p.Publish(context.Background(), []byte("dropped"), "key", nil); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
@@ -1,10 +1,11 @@
 package alice
 
 import (
-	"fmt"
+	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
 )
 
@@ -13,41 +14,252 @@ type connection struct {
 	conn         *amqp.Connection // The connection to the RabbitMQ broker
 	errorHandler func(error)      // The error handler for this connection
 	config       ConnectionConfig // Configuration for connection
+	dials        *uint32          // Number of connection attempts made by the broker, shared between its connections
+	log          Logger           // The logger of the connection and its consumers and producers
+	metrics      MetricsCollector // The metrics collector of the connection and its consumers and producers
+	tracer       Tracer           // The tracer of the connection's consumers and producers
+	events       *eventBus        // The bus the connection's events are emitted on, shared with the broker
+	ctx          context.Context  // Done once the connection has been shut down, stops reconnecting
+	cancel       func()           // Cancels ctx
+	mu           sync.RWMutex     // Guards the fields below
+	node         string           // Address of the node the connection is connected to
+	reconnected  chan struct{}    // Closed once the connection has been re-established or reconnecting has failed
+	err          error            // Terminal error once reconnecting has been given up on
+	lastErr      error            // The last error the connection was closed with or failed to reconnect with
+	connectedAt  time.Time        // When the connection was last (re-)established
+	blocked      bool             // Whether the broker has blocked the connection
+	blockReason  string           // The reason the broker gave for blocking the connection
+	unblocked    chan struct{}    // Closed once the connection is unblocked or replaced
 }
 
-// shutdown shuts down the connection to rabbitmq
-func (c *connection) shutdown() {
-	c.conn.Close()
+// newConnection creates a connection which is not connected yet
+// dials is the broker's connection attempt counter, used to distribute connections over the nodes
+// events is the broker's event bus
+func newConnection(config ConnectionConfig, dials *uint32, events *eventBus) *connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connection{
+		config:      config,
+		dials:       dials,
+		log:         config.logger(),
+		metrics:     config.metricsCollector(),
+		tracer:      config.messageTracer(),
+		events:      events,
+		ctx:         ctx,
+		cancel:      cancel,
+		reconnected: make(chan struct{}),
+		unblocked:   make(chan struct{}),
+	}
 }
 
-// Handle automatic restarting on connection closed
-// t is either "consumer" or "producer"
-func (c *connection) reconnect(t string, ch chan *amqp.Error) {
-	err := <-ch // Connection was closed for some reason
+// dial connects to one of the configured nodes
+// t is either "consumer" or "producer", or empty for a test connection
+func (c *connection) dial(t string) (*amqp.Connection, string, error) {
+	return c.config.dial(t, atomic.AddUint32(c.dials, 1)-1)
+}
 
-	log.Err(err).Str("connType", t).Msg("connection was closed")
+// currentNode returns the address of the node the connection is connected to
+func (c *connection) currentNode() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.node
+}
 
-	// Create new ticker with the desired connection delay time
-	ticker := time.NewTicker(c.config.reconnectDelay)
+// shutdown shuts down the connection to rabbitmq and stops reconnecting
+// Everyone waiting for the reconnect is woken up with ErrBrokerShutdown
+func (c *connection) shutdown() error {
+	c.mu.Lock()
+	c.cancel()
+	conn := c.conn
+	if c.err == nil {
+		c.err = ErrBrokerShutdown
+	}
+	close(c.reconnected)
+	c.reconnected = make(chan struct{})
+	c.mu.Unlock()
 
+	if conn == nil || conn.IsClosed() {
+		return nil
+	}
+	return conn.Close()
+}
+
+// channel opens a new channel on the current connection
+func (c *connection) channel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn == nil {
+		return nil, amqp.ErrClosed
+	}
+	return conn.Channel()
+}
+
+// waitUntilOpen blocks until the connection is open
+// Returns the terminal error once reconnecting has been given up on
+func (c *connection) waitUntilOpen() error {
 	for {
-		<-ticker.C // New tick
+		c.mu.RLock()
+		open := c.conn != nil && !c.conn.IsClosed()
+		reconnected := c.reconnected
+		err := c.err
+		c.mu.RUnlock()
+
+		if open {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		<-reconnected
+	}
+}
+
+// fail records the terminal error and wakes everyone waiting for the reconnect
+func (c *connection) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	close(c.reconnected)
+	c.reconnected = make(chan struct{})
+}
+
+// setConn replaces the RabbitMQ connection and wakes everyone waiting for the reconnect
+// Closes the RabbitMQ connection and returns ErrBrokerShutdown if the connection has been shut down in the meantime
+func (c *connection) setConn(conn *amqp.Connection, node string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ctx.Err() != nil {
+		conn.Close()
+		return ErrBrokerShutdown
+	}
+
+	c.conn = conn
+	c.node = node
+	c.connectedAt = time.Now()
+	close(c.reconnected)
+	c.reconnected = make(chan struct{})
+
+	// A new connection starts out unblocked
+	if c.blocked {
+		c.blocked = false
+		c.blockReason = ""
+		close(c.unblocked)
+		c.unblocked = make(chan struct{})
+	}
+	return nil
+}
+
+// Handle automatic restarting on connection closed
+// t is either "consumer" or "producer"
+// Once the backoff strategy gives up, the connection fails with ErrReconnectAttemptsExhausted
+func (c *connection) reconnect(t string, ch chan *amqp.Error) {
+	closeErr := <-ch // Connection was closed for some reason
 
-		var err error
+	// The connection was shut down on purpose
+	if c.ctx.Err() != nil {
+		return
+	}
 
-		log.Info().Str("connType", t).Msg("attempting to reconnect")
-		c.conn, err = amqp.Dial("amqp://" + c.config.user + ":" + c.config.password + "@" + c.config.host + ":" + fmt.Sprint(c.config.port))
+	c.log.Log(WarnLevel, "connection was closed", "err", amqpError(closeErr), "connType", t)
+	c.setLastError(amqpError(closeErr))
+	c.events.emit(Event{Type: Disconnected, ConnType: t, Node: c.currentNode(), Err: amqpError(closeErr)})
 
+	err := retryWithBackoff(c.ctx, c.config.reconnectBackoff(), false, func(attempt int) error {
+		c.log.Log(InfoLevel, "attempting to reconnect", "connType", t, "attempt", attempt)
+		c.events.emit(Event{Type: Reconnecting, ConnType: t, Attempt: attempt})
+		conn, node, err := c.dial(t)
+		c.metrics.ReconnectAttempted(t, err)
 		if err != nil {
-			log.Error().AnErr("err", err).Str("connType", t).Msg("failed to reconnect")
+			c.log.Log(ErrorLevel, "failed to reconnect", "err", err, "connType", t, "attempt", attempt)
+			c.setLastError(err)
+			return err
 		}
 
-		if !c.conn.IsClosed() {
-			go c.reconnect(t, c.conn.NotifyClose(make(chan *amqp.Error)))
-			ticker.Stop()
-			break
+		err = c.setConn(conn, node)
+		if err != nil {
+			return err
 		}
+
+		c.listenForBlocked(t, conn)
+		go c.reconnect(t, conn.NotifyClose(make(chan *amqp.Error)))
+		return nil
+	})
+	if c.ctx.Err() != nil {
+		return
 	}
+	if err != nil {
+		c.log.Log(ErrorLevel, "giving up reconnecting", "err", err, "connType", t)
+		c.fail(err)
+		return
+	}
+
+	c.log.Log(InfoLevel, "successfully reconnected", "connType", t, "node", c.currentNode())
+	c.events.emit(Event{Type: Reconnected, ConnType: t, Node: c.currentNode()})
+}
+
+// setLastError records the last error the connection was closed with or failed to reconnect with, nil errors are ignored
+func (c *connection) setLastError(err error) {
+	if err == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+}
 
-	log.Info().Str("connType", t).Msg("successfully reconnected")
+// listenForBlocked emits the blocked and unblocked notifications of a RabbitMQ connection
+// t is either "consumer" or "producer"
+func (c *connection) listenForBlocked(t string, conn *amqp.Connection) {
+	blockings := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+	go func() {
+		for blocking := range blockings {
+			c.setBlocked(conn, blocking)
+
+			if blocking.Active {
+				c.log.Log(WarnLevel, "connection was blocked", "connType", t, "reason", blocking.Reason)
+				c.events.emit(Event{Type: Blocked, ConnType: t, Node: c.currentNode(), Reason: blocking.Reason})
+			} else {
+				c.log.Log(InfoLevel, "connection was unblocked", "connType", t)
+				c.events.emit(Event{Type: Unblocked, ConnType: t, Node: c.currentNode()})
+			}
+		}
+	}()
+}
+
+// setBlocked records whether the broker blocked the RabbitMQ connection, waking everyone waiting for it to be unblocked
+// Notifications of a connection which has since been replaced are ignored
+func (c *connection) setBlocked(conn *amqp.Connection, blocking amqp.Blocking) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != conn {
+		return
+	}
+
+	c.blocked = blocking.Active
+	c.blockReason = blocking.Reason
+	if !blocking.Active {
+		close(c.unblocked)
+		c.unblocked = make(chan struct{})
+	}
+}
+
+// blockedState returns whether the broker blocked the connection, the reason it gave
+// and a channel which is closed once the connection is unblocked or replaced
+func (c *connection) blockedState() (bool, string, <-chan struct{}) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.blocked, c.blockReason, c.unblocked
+}
+
+// amqpError converts a possibly nil *amqp.Error to an error, so a nil pointer does not become a non-nil error
+func amqpError(err *amqp.Error) error {
+	if err == nil {
+		return nil
+	}
+	return err
 }
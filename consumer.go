@@ -1,113 +1,352 @@
 package alice
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
 )
 
 // RabbitConsumer models a RabbitMQ consumer
 type RabbitConsumer struct {
-	channel        *amqp.Channel       // Channel this consumer uses to communicate with broker
-	queue          *Queue              // The queue this consumer consumes from
-	conn           *connection         // Pointer to broker connection
-	autoAck        bool                // Whether this consumer want autoAck
-	tag            string              // Consumer tag
-	args           amqp.Table          // Additional arguments when consuming messages
-	messageHandler func(amqp.Delivery) // Message handler to call if this consumer receives a message
-	routingKey     string              // Routing key this consumer listens to
+	channel    *amqp.Channel   // Channel this consumer uses to communicate with broker
+	queue      *Queue          // The queue this consumer consumes from
+	conn       *connection     // Pointer to broker connection
+	tag        string          // Consumer tag
+	args       amqp.Table      // Additional arguments when consuming messages
+	handler    Handler         // Handler to call if this consumer receives a message
+	routingKey string          // Routing key this consumer listens to
+	config     *ConsumerConfig // The configuration of this consumer
+	workers    chan struct{}   // Semaphore bounding the number of running message handlers, nil if unbounded
+	handlers   sync.WaitGroup  // Message handlers which are still running
+	mu         sync.Mutex      // Guards the fields below
+	closed     bool            // Whether the consumer has been shut down
+	available  bool            // Whether the channel is open
+	lastErr    error           // The last error the channel was closed with or failed to re-open with
+	consuming  chan struct{}   // Closed once the current consumption has ended, nil if the consumer never consumed
+
+	retryMutex    sync.Mutex             // Guards the fields below and serializes retry publishes, so each one waits for its own confirmation
+	retryConfirms chan amqp.Confirmation // Confirmations of retry publishes, nil without a retry policy
+	retryReturns  chan amqp.Return       // Retry publishes the broker could not route
 }
 
 /*
 ConsumeMessages starts the consumption of messages from the queue the consumer is bound to
 	args: amqp.Table, additional arguments for this consumer
-	autoAck: bool, whether to automatically acknowledge messages
+	autoAck: bool, whether to automatically acknowledge messages once the handler returns. Messages whose handler panicked are acknowledged with the consumer's panic disposition
 	messageHandler: func(amqp.Delivery), a handler for incoming messages. Every message the handler is called in a new goroutine
+	When the consumer is configured with a max concurrency, consumption pauses while that many handlers are running
 */
 func (c *RabbitConsumer) ConsumeMessages(args amqp.Table, autoAck bool, messageHandler func(amqp.Delivery)) {
+	c.Consume(args, legacyHandler(autoAck, messageHandler))
+}
+
+/*
+Consume starts the consumption of messages from the queue the consumer is bound to
+Every delivery is acknowledged according to the outcome of the handler, see Handler
+	args: amqp.Table, additional arguments for this consumer
+	handler: Handler, a handler for incoming messages. Every message the handler is called in a new goroutine
+	When the consumer is configured with a max concurrency, consumption pauses while that many handlers are running
+*/
+func (c *RabbitConsumer) Consume(args amqp.Table, handler Handler) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	consuming := make(chan struct{})
+	c.consuming = consuming
+	c.mu.Unlock()
+	defer close(consuming)
+
 	messages, err := c.channel.Consume(
 		c.queue.name,
 		c.tag,
-		c.autoAck,
+		false,
 		false,
 		false,
 		false,
 		args,
 	)
 	if err != nil {
-		log.Error().AnErr("err", err).Str("type", "consumer").Str("consumerTag", c.tag).Str("routingKey", c.routingKey).Msg("failed to consume messages")
+		c.conn.log.Log(ErrorLevel, "failed to consume messages", "err", err, "type", "consumer", "consumerTag", c.tag, "routingKey", c.routingKey)
+		return
 	}
 
 	// Set some more consumer attributes
-	c.autoAck = autoAck
 	c.args = args
-	c.messageHandler = messageHandler
+	c.handler = handler
+	handler = wrapHandler(handler, c.conn.config.consumerMiddleware, c.config)
 
 	// Listen for incoming messages and pass them to the message handler
-	log.Info().Str("type", "consumer").Str("consumerTag", c.tag).Str("routingKey", c.routingKey).Msg("starting message consumption")
+	c.conn.log.Log(InfoLevel, "starting message consumption", "type", "consumer", "consumerTag", c.tag, "routingKey", c.routingKey)
 	for message := range messages {
-		log.Trace().Str("type", "consumer").Str("consumerTag", c.tag).Str("routingKey", c.routingKey).Str("exchange", message.Exchange).Int("msgSize", len(message.Body)).Msg("received message")
+		c.conn.log.Log(TraceLevel, "received message", "type", "consumer", "consumerTag", c.tag, "routingKey", c.routingKey, "exchange", message.Exchange, "msgSize", len(message.Body))
+		c.conn.metrics.MessageDelivered(c.queue.name, c.routingKey, c.tag)
+
+		// Wait for a free worker
+		c.acquireWorker()
+		c.handlers.Add(1)
+
 		go func(message amqp.Delivery) {
-			// Intercept any errors propagating up the stack
-			defer func() {
-				if err := recover(); err != nil {
-					log.Error().Str("type", "consumer").AnErr("err", err.(error)).Msg("error occurred in message handler")
-				}
-
-				if autoAck {
-					message.Ack(true)
-					log.Trace().Str("type", "consumer").Str("consumerTag", c.tag).Str("routingKey", c.routingKey).Str("msgID", message.MessageId).Msg("automatically acked message")
-				}
-			}()
-
-			// Call the message handler
-			messageHandler(message)
+			defer c.handlers.Done()
+			defer c.releaseWorker()
+			c.handleDelivery(handler, message)
 		}(message)
 	}
 }
 
+// handleDelivery calls the handler for a delivery and acknowledges it according to the outcome
+func (c *RabbitConsumer) handleDelivery(handler Handler, message amqp.Delivery) {
+	c.conn.metrics.HandlerStarted(c.queue.name, c.routingKey, c.tag)
+	start := time.Now()
+
+	disposition := c.callHandler(handler, message)
+	duration := time.Since(start)
+	defer func() {
+		c.conn.metrics.MessageHandled(c.queue.name, c.routingKey, c.tag, disposition, duration)
+	}()
+
+	// Route failed deliveries through the retry queues
+	if c.config.retryPolicy != nil && (disposition == Nack || disposition == Requeue || disposition == Reject) {
+		disposition = c.retry(message, disposition)
+	}
+
+	err := acknowledge(message, disposition)
+	if err != nil {
+		c.conn.log.Log(ErrorLevel, "failed to acknowledge message", "err", err, "type", "consumer", "consumerTag", c.tag, "routingKey", c.routingKey, "disposition", disposition.String())
+		return
+	}
+
+	c.conn.log.Log(TraceLevel, "handled message", "type", "consumer", "consumerTag", c.tag, "routingKey", c.routingKey, "msgID", message.MessageId, "disposition", disposition.String())
+}
+
+// retry publishes a failed delivery to the next retry queue, or to the parking queue once it is out of attempts
+// Returns the disposition to acknowledge the original delivery with
+func (c *RabbitConsumer) retry(message amqp.Delivery, disposition Disposition) Disposition {
+	policy := c.config.retryPolicy
+	retries := retryCount(message)
+
+	// Rejected and exhausted deliveries are parked
+	target := policy.parkingQueueName(c.queue)
+	if disposition != Reject && retries+1 < policy.maxAttempts {
+		retries++
+		target = retryQueueName(c.queue, policy.delay(retries))
+	}
+
+	// The original delivery is only acknowledged once the broker has confirmed the routed copy
+	err := c.publishRetry(target, retryPublishing(message, retries))
+	if err != nil {
+		fallback := retryFallback(err)
+		c.conn.log.Log(ErrorLevel, "failed to route message for retry", "err", err, "type", "consumer", "consumerTag", c.tag, "queue", target, "disposition", fallback.String())
+		return fallback
+	}
+
+	c.conn.log.Log(DebugLevel, "routed failed message", "type", "consumer", "consumerTag", c.tag, "queue", target, "retries", retries)
+
+	return Ack
+}
+
+// publishRetry publishes a failed delivery to a retry or parking queue as a mandatory message and waits until the broker has confirmed it
+// Returns ErrUnroutable if the queue does not exist, ErrNacked or ErrChannelClosed
+func (c *RabbitConsumer) publishRetry(queue string, publishing amqp.Publishing) error {
+	c.retryMutex.Lock()
+	defer c.retryMutex.Unlock()
+
+	err := c.channel.Publish("", queue, true, false, publishing)
+	if err != nil {
+		if err == amqp.ErrClosed {
+			err = ErrChannelClosed
+		}
+		return err
+	}
+
+	confirmation, ok := <-c.retryConfirms
+	if !ok {
+		return ErrChannelClosed
+	}
+
+	// The broker returns an unroutable message before confirming it
+	select {
+	case returned := <-c.retryReturns:
+		return fmt.Errorf("%w: %s", ErrUnroutable, returned.ReplyText)
+	default:
+	}
+
+	if !confirmation.Ack {
+		return ErrNacked
+	}
+	return nil
+}
+
+// retryFallback returns the disposition of a failed delivery which could not be routed for retry
+// Unroutable deliveries are rejected so the queue's dead letter exchange keeps them, otherwise they are requeued
+func retryFallback(err error) Disposition {
+	if errors.Is(err, ErrUnroutable) {
+		return Reject
+	}
+	return Requeue
+}
+
+// callHandler calls the handler and returns the resulting disposition
+// The handler's context carries the span of handling the message, continuing the trace of the publisher
+func (c *RabbitConsumer) callHandler(handler Handler, message amqp.Delivery) Disposition {
+	ctx, span := startDeliverySpan(c.conn.tracer, c.queue.name, c.tag, message)
+	defer span.End()
+
+	// Call the message handler, panics are turned into errors by the Recover middleware
+	err := handler(ctx, message)
+	if err != nil {
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			c.conn.log.Log(ErrorLevel, "error occurred in message handler", "type", "consumer", "consumerTag", c.tag, "err", panicErr.Value)
+		} else {
+			c.conn.log.Log(DebugLevel, "message handler returned an error", "err", err, "type", "consumer", "consumerTag", c.tag, "routingKey", c.routingKey)
+		}
+		span.RecordError(err)
+	}
+
+	return dispositionOf(err, c.config.errorDisposition)
+}
+
+// wrapHandler wraps a handler with the panic recovery, the broker's consumer middleware and the consumer's own middleware
+func wrapHandler(handler Handler, brokerMiddleware []Middleware, config *ConsumerConfig) Handler {
+	middleware := make([]Middleware, 0, 1+len(brokerMiddleware)+len(config.middleware))
+	middleware = append(middleware, Recover(config.panicDisposition))
+	middleware = append(middleware, brokerMiddleware...)
+	middleware = append(middleware, config.middleware...)
+
+	return Chain(handler, middleware...)
+}
+
+// legacyHandler adapts a handler passed to ConsumeMessages to a Handler
+// Without autoAck the message handler acknowledges deliveries itself, also when it panics
+func legacyHandler(autoAck bool, messageHandler func(amqp.Delivery)) Handler {
+	if autoAck {
+		return func(ctx context.Context, delivery amqp.Delivery) error {
+			messageHandler(delivery)
+			return nil
+		}
+	}
+
+	return Chain(func(ctx context.Context, delivery amqp.Delivery) error {
+		messageHandler(delivery)
+		return WithDisposition(nil, Manual)
+	}, Recover(Manual))
+}
+
+// acquireWorker blocks until a message handler may be started
+func (c *RabbitConsumer) acquireWorker() {
+	if c.workers != nil {
+		c.workers <- struct{}{}
+	}
+}
+
+// releaseWorker frees up the worker of a finished message handler
+func (c *RabbitConsumer) releaseWorker() {
+	if c.workers != nil {
+		<-c.workers
+	}
+}
+
 // createConsumer creates a new Consumer on this connection
-func (c *connection) createConsumer(queue *Queue, routingKey string, consumerTag string) (Consumer, error) {
+func (c *connection) createConsumer(queue *Queue, routingKey string, consumerTag string, config *ConsumerConfig) (*RabbitConsumer, error) {
+	// Generate a tag when none is given, it is needed to cancel the consumer
+	if consumerTag == "" {
+		consumerTag = uniqueConsumerTag()
+	}
+
 	consumer := &RabbitConsumer{
 		channel:    nil,
 		queue:      queue,
 		conn:       c,
 		tag:        consumerTag,
 		routingKey: routingKey,
+		config:     config,
 	}
 
+	if config.maxConcurrency > 0 {
+		consumer.workers = make(chan struct{}, config.maxConcurrency)
+	}
+
+	err := consumer.setup()
+	if err != nil {
+		return nil, err
+	}
+
+	c.log.Log(InfoLevel, "created consumer", "type", "consumer", "queue", queue.name, "routingKey", routingKey, "consumerTag", consumerTag)
+
+	return consumer, nil
+}
+
+// setup opens the consumer's channel, declares its exchange and queues and listens for the channel closing
+func (c *RabbitConsumer) setup() error {
 	var err error
 
 	//Connects to the channel
-	consumer.channel, err = c.conn.Channel()
+	c.channel, err = c.conn.channel()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	//Limits the unacknowledged deliveries
+	err = c.setQos()
+	if err != nil {
+		return err
 	}
 
 	//Connects to exchange
-	err = consumer.declareExchange(queue.exchange)
+	err = c.declareExchange(c.queue.exchange)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	//Creates the queue
-	_, err = consumer.declareQueue(queue)
+	_, err = c.declareQueue(c.queue)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	//Binds the queue to the exchange
-	err = consumer.bindQueue(queue, routingKey)
+	err = c.bindQueue(c.queue, c.routingKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	consumer.listenForClose()
+	//Creates the retry and parking queues
+	err = c.declareRetryQueues()
+	if err != nil {
+		return err
+	}
 
-	log.Info().Str("type", "consumer").Str("queue", queue.name).Str("routingKey", routingKey).Str("consumerTag", consumerTag).Msg("created consumer")
+	//Confirms the publishes of failed deliveries to the retry queues
+	err = c.enableRetryConfirms()
+	if err != nil {
+		return err
+	}
 
-	return consumer, nil
+	c.listenForClose()
+	c.listenForCancel()
+
+	c.mu.Lock()
+	c.available = true
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *RabbitConsumer) setQos() error {
+	e := c.channel.Qos(
+		c.config.prefetchCount,
+		c.config.prefetchSize,
+		false,
+	)
+	return e
 }
 
 func (c *RabbitConsumer) declareExchange(exchange *Exchange) error {
@@ -146,76 +385,215 @@ func (c *RabbitConsumer) bindQueue(queue *Queue, bindingKey string) error {
 	return e
 }
 
+// declareRetryQueues declares the retry queues and the parking queue of the consumer's retry policy
+func (c *RabbitConsumer) declareRetryQueues() error {
+	policy := c.config.retryPolicy
+	if policy == nil {
+		return nil
+	}
+
+	for _, delay := range policy.delays() {
+		_, err := c.channel.QueueDeclare(
+			retryQueueName(c.queue, delay),
+			c.queue.durable,
+			false,
+			false,
+			false,
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": c.queue.name,
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := c.channel.QueueDeclare(
+		policy.parkingQueueName(c.queue),
+		c.queue.durable,
+		false,
+		false,
+		false,
+		nil,
+	)
+	return err
+}
+
+// enableRetryConfirms puts the channel into confirm mode when the consumer has a retry policy
+func (c *RabbitConsumer) enableRetryConfirms() error {
+	if c.config.retryPolicy == nil {
+		return nil
+	}
+
+	err := c.channel.Confirm(false)
+	if err != nil {
+		return err
+	}
+
+	c.retryMutex.Lock()
+	c.retryConfirms = c.channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	c.retryReturns = c.channel.NotifyReturn(make(chan amqp.Return, 1))
+	c.retryMutex.Unlock()
+	return nil
+}
+
 func (c *RabbitConsumer) listenForClose() {
 	closeChan := c.channel.NotifyClose(make(chan *amqp.Error))
 	go func() {
 		closeErr := <-closeChan
-		log.Error().Str("type", "consumer").AnErr("err", closeErr).Str("routingKey", c.routingKey).Str("consumerTag", c.tag).Msg("connection was closed")
-		c.reconnect()
+
+		// Ignore shutdowns
+		c.mu.Lock()
+		closed := c.closed
+		c.available = false
+		if closeErr != nil {
+			c.lastErr = closeErr
+		}
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+
+		c.conn.log.Log(ErrorLevel, "connection was closed", "type", "consumer", "err", amqpError(closeErr), "routingKey", c.routingKey, "consumerTag", c.tag)
+		c.conn.events.emit(Event{Type: ChannelClosed, ConnType: "consumer", Node: c.conn.currentNode(), Queue: c.queue.name, ConsumerTag: c.tag, Err: amqpError(closeErr)})
+
+		err := c.reconnect()
+		if err != nil && c.conn.ctx.Err() == nil {
+			c.conn.log.Log(ErrorLevel, "giving up reconnecting", "err", err, "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag)
+		}
+	}()
+}
+
+// listenForCancel emits an event when the broker cancels the consumer, e.g. because its queue was deleted
+func (c *RabbitConsumer) listenForCancel() {
+	cancelChan := c.channel.NotifyCancel(make(chan string, 1))
+	go func() {
+		for tag := range cancelChan {
+			c.conn.log.Log(WarnLevel, "consumer was cancelled by the broker", "type", "consumer", "routingKey", c.routingKey, "consumerTag", tag)
+			c.conn.events.emit(Event{Type: ConsumerCancelled, ConnType: "consumer", Node: c.conn.currentNode(), Queue: c.queue.name, ConsumerTag: tag})
+		}
 	}()
 }
 
 // ReconnectChannel tries to re-open this consumers channel
 func (c *RabbitConsumer) ReconnectChannel() error {
-	log.Info().Str("type", "consumer").Str("routingKey", c.routingKey).Str("consumerTag", c.tag).Msg("attempting to re-open channel")
+	c.conn.log.Log(InfoLevel, "attempting to re-open channel", "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag)
 	var err error
-	c.channel, err = c.conn.conn.Channel()
+	c.channel, err = c.conn.channel()
 	if err != nil {
-		log.Error().AnErr("err", err).Str("type", "consumer").Str("routingKey", c.routingKey).Str("consumerTag", c.tag).Msg("failed to re-open channel")
+		c.conn.log.Log(ErrorLevel, "failed to re-open channel", "err", err, "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag)
 	}
 	return err
 }
 
 // Shutdown shuts down the consumer
 func (c *RabbitConsumer) Shutdown() error {
-	log.Info().Str("type", "consumer").Str("routingKey", c.routingKey).Str("consumerTag", c.tag).Msg("shutting down consumer")
+	c.conn.log.Log(InfoLevel, "shutting down consumer", "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag)
+
+	c.mu.Lock()
+	c.closed = true
+	c.available = false
+	c.mu.Unlock()
+
 	return c.channel.Close()
 }
 
-func (c *RabbitConsumer) reconnect() error {
-	// Wait for the connection to be open again
-	// Create new ticker with the desired connection delay time
-	ticker := time.NewTicker(time.Second * 10)
-
-	for {
-		<-ticker.C // New tick
+// drain stops consuming, waits for the running message handlers to finish and acknowledge their messages and closes the channel
+// Returns the context's error if the handlers did not finish in time, the channel is closed regardless
+func (c *RabbitConsumer) drain(ctx context.Context) error {
+	c.conn.log.Log(InfoLevel, "draining consumer", "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag)
+
+	c.mu.Lock()
+	c.closed = true
+	c.available = false
+	consuming := c.consuming
+	c.mu.Unlock()
+
+	// Stop new deliveries, the ones already received are still handled
+	err := c.channel.Cancel(c.tag, false)
+	if err != nil && err != amqp.ErrClosed {
+		c.conn.log.Log(ErrorLevel, "failed to cancel consumer", "err", err, "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag)
+	}
 
-		// Check if connection is open yet
-		if !c.conn.conn.IsClosed() {
-			// Attempt to re-connect
-			var err error
+	// Wait for the consumption to end, after which no more handlers are started
+	var drainErr error
+	if consuming != nil {
+		select {
+		case <-consuming:
+			drainErr = waitContext(ctx, c.handlers.Wait)
+		case <-ctx.Done():
+			drainErr = ctx.Err()
+		}
+	}
 
-			//Connects to the channel
-			c.channel, err = c.conn.conn.Channel()
-			if err != nil {
-				return err
-			}
+	closeErr := c.channel.Close()
+	if drainErr != nil {
+		return drainErr
+	}
+	if closeErr == amqp.ErrClosed {
+		return nil
+	}
+	return closeErr
+}
 
-			//Connects to exchange
-			err = c.declareExchange(c.queue.exchange)
-			if err != nil {
-				return err
-			}
+// waitContext calls wait and returns once it returns or the context is done, in which case the context's error is returned
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
 
-			//Creates the queue
-			_, err = c.declareQueue(c.queue)
-			if err != nil {
-				return err
-			}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-			//Binds the queue to the exchange
-			err = c.bindQueue(c.queue, c.routingKey)
-			if err != nil {
-				return err
-			}
+// consumerTags counts the generated consumer tags
+var consumerTags uint64
 
-			c.listenForClose()
+// uniqueConsumerTag generates a consumer tag for a consumer created without one, in the same format the amqp library uses
+func uniqueConsumerTag() string {
+	return fmt.Sprintf("ctag-%s-%d", os.Args[0], atomic.AddUint64(&consumerTags, 1))
+}
 
-			log.Info().Str("type", "consumer").Str("routingKey", c.routingKey).Str("consumerTag", c.tag).Msg("reconnected")
+// reconnect re-opens the consumer's channel once the connection is open and resumes consumption
+// Setting up the channel is retried according to the connection's backoff strategy
+// Returns the terminal error once the connection or the backoff strategy gives up
+func (c *RabbitConsumer) reconnect() error {
+	var connErr error
+	err := retryWithBackoff(c.conn.ctx, c.conn.config.reconnectBackoff(), true, func(attempt int) error {
+		// Wait for the connection to be open again
+		connErr = c.conn.waitUntilOpen()
+		if connErr != nil {
+			return nil
+		}
 
-			go c.ConsumeMessages(c.args, c.autoAck, c.messageHandler)
+		err := c.setup()
+		if err != nil {
+			c.conn.log.Log(ErrorLevel, "failed to reconnect", "err", err, "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag, "attempt", attempt)
 
-			return nil
+			c.mu.Lock()
+			c.lastErr = err
+			c.mu.Unlock()
 		}
+		return err
+	})
+	if connErr != nil {
+		return connErr
 	}
+	if err != nil {
+		return err
+	}
+
+	c.conn.log.Log(InfoLevel, "reconnected", "type", "consumer", "routingKey", c.routingKey, "consumerTag", c.tag)
+
+	go c.Consume(c.args, c.handler)
+
+	return nil
 }
@@ -0,0 +1,74 @@
+package alice
+
+// ConsumerConfig is a config structure to use when creating a consumer
+type ConsumerConfig struct {
+	prefetchCount  int // Maximum number of unacknowledged deliveries the broker sends, 0 means unlimited
+	prefetchSize   int // Maximum number of unacknowledged bytes the broker sends, 0 means unlimited
+	maxConcurrency int // Maximum number of message handlers running at once, 0 means unlimited
+
+	errorDisposition Disposition // How a delivery is acknowledged when its handler returns a plain error
+	panicDisposition Disposition // How a delivery is acknowledged when its handler panics
+
+	retryPolicy *RetryPolicy // How failed deliveries are retried, nil to disable retries
+
+	middleware []Middleware // Wraps the handler of the consumer
+}
+
+// DefaultConsumerConfig is the configuration used by CreateConsumer.
+//	prefetchCount: 0, prefetchSize: 0, maxConcurrency: 0, errorDisposition: Nack, panicDisposition: Nack, retryPolicy: nil
+var DefaultConsumerConfig = CreateConsumerConfig()
+
+// CreateConsumerConfig creates a consumer configuration with the default settings
+func CreateConsumerConfig() *ConsumerConfig {
+	return &ConsumerConfig{
+		prefetchCount:  0,
+		prefetchSize:   0,
+		maxConcurrency: 0,
+
+		errorDisposition: Nack,
+		panicDisposition: Nack,
+	}
+}
+
+// SetPrefetchCount sets the maximum number of unacknowledged deliveries the broker sends to the consumer, 0 means unlimited
+func (config *ConsumerConfig) SetPrefetchCount(prefetchCount int) {
+	config.prefetchCount = prefetchCount
+}
+
+// SetPrefetchSize sets the maximum number of unacknowledged bytes the broker sends to the consumer, 0 means unlimited
+// RabbitMQ does not implement prefetch size and rejects a non-zero value
+func (config *ConsumerConfig) SetPrefetchSize(prefetchSize int) {
+	config.prefetchSize = prefetchSize
+}
+
+// SetMaxConcurrency sets the maximum number of message handlers running at once, 0 means every delivery is handled in a new goroutine right away
+// Combine with a prefetch count of at least the same size to bound the number of in-flight deliveries end to end
+func (config *ConsumerConfig) SetMaxConcurrency(maxConcurrency int) {
+	config.maxConcurrency = maxConcurrency
+}
+
+// SetErrorDisposition sets how a delivery is acknowledged when its handler returns an error not created by WithDisposition
+func (config *ConsumerConfig) SetErrorDisposition(disposition Disposition) {
+	config.errorDisposition = disposition
+}
+
+// SetPanicDisposition sets how a delivery is acknowledged when its handler panics
+func (config *ConsumerConfig) SetPanicDisposition(disposition Disposition) {
+	config.panicDisposition = disposition
+}
+
+// SetRetryPolicy sets how failed deliveries are retried, nil disables retries
+// With a retry policy, deliveries with the Nack or Requeue disposition are redelivered after a delay until the policy runs out of attempts.
+// Exhausted deliveries and deliveries with the Reject disposition are routed to the parking queue.
+// The retry and parking queues are declared along with the consumer's queue.
+// The consumer's channel is put into confirm mode, so a delivery is only acknowledged once the broker has confirmed its routed copy;
+// otherwise it is requeued, or rejected if the retry or parking queue does not exist so its dead letter exchange keeps it.
+func (config *ConsumerConfig) SetRetryPolicy(policy *RetryPolicy) {
+	config.retryPolicy = policy
+}
+
+// AddMiddleware adds middleware wrapping the handler of consumers created with this configuration
+// It runs inside the broker's consumer middleware, in the order it was added, see Middleware
+func (config *ConsumerConfig) AddMiddleware(middleware ...Middleware) {
+	config.middleware = append(config.middleware, middleware...)
+}
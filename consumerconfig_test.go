@@ -0,0 +1,54 @@
+package alice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumerConfig(t *testing.T) {
+	config := CreateConsumerConfig()
+	if config.prefetchCount != 0 || config.prefetchSize != 0 || config.maxConcurrency != 0 {
+		t.Errorf("default config = %+v, want no limits", config)
+	}
+
+	config.SetPrefetchCount(20)
+	config.SetPrefetchSize(4096)
+	config.SetMaxConcurrency(5)
+	if config.prefetchCount != 20 || config.prefetchSize != 4096 || config.maxConcurrency != 5 {
+		t.Errorf("config = %+v, want prefetch count 20, prefetch size 4096 and max concurrency 5", config)
+	}
+}
+
+func TestConsumerMaxConcurrency(t *testing.T) {
+	c := &RabbitConsumer{workers: make(chan struct{}, 2)}
+	c.acquireWorker()
+	c.acquireWorker()
+
+	// A third handler waits for a running one to finish
+	acquired := make(chan struct{})
+	go func() {
+		c.acquireWorker()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected the third handler to wait for a free worker")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	c.releaseWorker()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected the third handler to start once a worker was released")
+	}
+}
+
+func TestConsumerUnboundedConcurrency(t *testing.T) {
+	c := &RabbitConsumer{}
+	for i := 0; i < 100; i++ {
+		c.acquireWorker()
+	}
+	c.releaseWorker()
+}
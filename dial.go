@@ -0,0 +1,123 @@
+package alice
+
+import (
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+// externalAuth implements the SASL EXTERNAL mechanism, the broker authenticates the TLS client certificate
+type externalAuth struct{}
+
+// Mechanism returns "EXTERNAL"
+func (auth *externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+// Response returns an empty response, the identity is taken from the client certificate
+func (auth *externalAuth) Response() string {
+	return ""
+}
+
+// uri forms the RabbitMQ connection URI of a node, escaping the credentials
+func (config *ConnectionConfig) uri(node string) string {
+	scheme := "amqp"
+	if config.tlsConfig != nil {
+		scheme = "amqps"
+	}
+
+	u := url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(config.user, config.password),
+		Host:   node,
+	}
+	return u.String()
+}
+
+// nodeAddresses returns the addresses of the nodes to connect to, the configured host and port if no nodes are set
+func (config *ConnectionConfig) nodeAddresses() []string {
+	if len(config.nodes) == 0 {
+		return []string{net.JoinHostPort(config.host, strconv.Itoa(config.port))}
+	}
+	return config.nodes
+}
+
+// nodeOrder returns the order in which the nodes are tried during the given connection attempt
+func (config *ConnectionConfig) nodeOrder(attempt uint32) []string {
+	nodes := config.nodeAddresses()
+	order := make([]string, 0, len(nodes))
+
+	switch config.nodeSelection {
+	case RoundRobinSelection:
+		start := int(attempt % uint32(len(nodes)))
+		order = append(order, nodes[start:]...)
+		order = append(order, nodes[:start]...)
+	case RandomSelection:
+		for _, i := range rand.Perm(len(nodes)) {
+			order = append(order, nodes[i])
+		}
+	default:
+		order = append(order, nodes...)
+	}
+
+	return order
+}
+
+// amqpConfig creates the amqp dial configuration
+// connType is either "consumer" or "producer" and is appended to the connection name
+func (config *ConnectionConfig) amqpConfig(connType string) amqp.Config {
+	amqpConfig := amqp.Config{
+		Vhost:      config.vhost,
+		Heartbeat:  config.heartbeat,
+		ChannelMax: config.channelMax,
+		FrameSize:  config.frameSize,
+		Locale:     config.locale,
+	}
+
+	// The amqp package adds its capabilities to the client properties, so hand it a copy
+	if len(config.properties) > 0 || config.connectionName != "" {
+		amqpConfig.Properties = make(amqp.Table, len(config.properties)+1)
+		for key, value := range config.properties {
+			amqpConfig.Properties[key] = value
+		}
+
+		if config.connectionName != "" {
+			name := config.connectionName
+			if connType != "" {
+				name += " (" + connType + ")"
+			}
+			amqpConfig.Properties["connection_name"] = name
+		}
+	}
+
+	// The amqp package fills in the server name, so hand it a copy
+	if config.tlsConfig != nil {
+		amqpConfig.TLSClientConfig = config.tlsConfig.Clone()
+	}
+
+	if config.externalAuth {
+		amqpConfig.SASL = []amqp.Authentication{&externalAuth{}}
+	}
+
+	return amqpConfig
+}
+
+// dial connects to the first node accepting the connection, in the order of the node selection
+// connType is either "consumer" or "producer", or empty for a connection which is not used by either
+// Returns the connection, the address of the node and the error of the last node if none accepted the connection
+func (config *ConnectionConfig) dial(connType string, attempt uint32) (*amqp.Connection, string, error) {
+	var err error
+	for _, node := range config.nodeOrder(attempt) {
+		var conn *amqp.Connection
+		conn, err = amqp.DialConfig(config.uri(node), config.amqpConfig(connType))
+		if err == nil {
+			return conn, node, nil
+		}
+
+		config.logger().Log(WarnLevel, "failed to connect to node", "err", err, "connType", connType, "node", node)
+	}
+	return nil, "", err
+}
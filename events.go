@@ -0,0 +1,173 @@
+package alice
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// EventType identifies the kind of state change an Event describes
+type EventType int
+
+const (
+	// Connected is emitted once a consumer or producer connection is first established
+	Connected EventType = iota
+	// Disconnected is emitted when a connection is lost
+	Disconnected
+	// Reconnecting is emitted before every reconnection attempt
+	Reconnecting
+	// Reconnected is emitted once a lost connection is re-established
+	Reconnected
+	// ChannelClosed is emitted when a consumer or producer channel is closed unexpectedly
+	ChannelClosed
+	// FlowPaused is emitted when the broker asks a producer to stop publishing
+	FlowPaused
+	// FlowResumed is emitted when the broker allows a producer to publish again
+	FlowResumed
+	// Blocked is emitted when the broker blocks a connection, e.g. because it is low on memory or disk space
+	Blocked
+	// Unblocked is emitted when the broker unblocks a connection
+	Unblocked
+	// MessageReturned is emitted when the broker returns a message which could not be routed
+	MessageReturned
+	// ConsumerCancelled is emitted when the broker cancels a consumer, e.g. because its queue was deleted
+	ConsumerCancelled
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Reconnecting:
+		return "reconnecting"
+	case Reconnected:
+		return "reconnected"
+	case ChannelClosed:
+		return "channel closed"
+	case FlowPaused:
+		return "flow paused"
+	case FlowResumed:
+		return "flow resumed"
+	case Blocked:
+		return "blocked"
+	case Unblocked:
+		return "unblocked"
+	case MessageReturned:
+		return "message returned"
+	case ConsumerCancelled:
+		return "consumer cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change in the state of a broker's connections or channels
+type Event struct {
+	Type        EventType    // The kind of state change
+	Time        time.Time    // When the state changed
+	ConnType    string       // The connection the event belongs to, "consumer" or "producer"
+	Node        string       // Address of the node the connection is (or was) connected to, if known
+	Exchange    string       // The exchange of the producer the event belongs to, if any
+	Queue       string       // The queue of the consumer the event belongs to, if any
+	ConsumerTag string       // The tag of the consumer the event belongs to, if any
+	Attempt     int          // The reconnection attempt, for Reconnecting events
+	Reason      string       // The reason given by the broker, for Blocked events
+	Return      *amqp.Return // The returned message, for MessageReturned events
+	Err         error        // The error which caused the event, if any
+}
+
+// eventBufferSize is the number of events a subscription buffers before dropping new ones
+const eventBufferSize = 64
+
+// A Subscription receives the events a broker emits
+type Subscription struct {
+	events chan Event         // Buffered channel the events are delivered on
+	types  map[EventType]bool // The event types subscribed to, empty for all
+	bus    *eventBus          // The bus this subscription is registered with
+	once   sync.Once          // Guards closing the events channel
+}
+
+// Events returns the channel the events are delivered on, it is closed once the subscription is cancelled
+// Events are dropped when the subscriber falls behind, so emitting never blocks the broker
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Unsubscribe cancels the subscription and closes its events channel
+func (s *Subscription) Unsubscribe() {
+	s.bus.unsubscribe(s)
+}
+
+// eventBus delivers events to the subscriptions registered with it
+type eventBus struct {
+	log           Logger                     // The logger dropped events are reported to
+	mu            sync.RWMutex               // Guards the field below
+	subscriptions map[*Subscription]struct{} // The registered subscriptions
+}
+
+// newEventBus creates an event bus without subscriptions
+func newEventBus(logger Logger) *eventBus {
+	return &eventBus{
+		log:           logger,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe registers a subscription to the given event types, all types when none are given
+func (b *eventBus) subscribe(types ...EventType) *Subscription {
+	s := &Subscription{
+		events: make(chan Event, eventBufferSize),
+		types:  make(map[EventType]bool, len(types)),
+		bus:    b,
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	b.mu.Lock()
+	b.subscriptions[s] = struct{}{}
+	b.mu.Unlock()
+
+	return s
+}
+
+// unsubscribe removes a subscription and closes its events channel
+func (b *eventBus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	delete(b.subscriptions, s)
+	b.mu.Unlock()
+
+	s.once.Do(func() {
+		close(s.events)
+	})
+}
+
+// emit delivers an event to every subscription interested in it, dropping it for subscriptions which are full
+func (b *eventBus) emit(event Event) {
+	if b == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subscriptions {
+		if len(s.types) > 0 && !s.types[event.Type] {
+			continue
+		}
+
+		select {
+		case s.events <- event:
+		default:
+			b.log.Log(WarnLevel, "subscriber is falling behind, dropped event", "event", event.Type.String())
+		}
+	}
+}
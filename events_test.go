@@ -0,0 +1,53 @@
+package alice
+
+import (
+	"testing"
+)
+
+func TestSubscribeFiltersEventTypes(t *testing.T) {
+	broker := CreateMockBroker().(*MockBroker)
+
+	subscription := broker.Subscribe(Disconnected, Reconnected)
+	defer subscription.Unsubscribe()
+
+	broker.Emit(Event{Type: Connected, ConnType: "producer"})
+	broker.Emit(Event{Type: Disconnected, ConnType: "producer"})
+	broker.Emit(Event{Type: Reconnected, ConnType: "producer"})
+
+	for _, want := range []EventType{Disconnected, Reconnected} {
+		event := <-subscription.Events()
+		if event.Type != want {
+			t.Errorf("event = %s, want %s", event.Type, want)
+		}
+		if event.Time.IsZero() {
+			t.Error("expected the event time to be set")
+		}
+	}
+
+	select {
+	case event := <-subscription.Events():
+		t.Errorf("unexpected event %s", event.Type)
+	default:
+	}
+}
+
+func TestEmitDropsEventsForSlowSubscribers(t *testing.T) {
+	bus := newEventBus(CreateNopLogger())
+	subscription := bus.subscribe()
+
+	// Emitting must never block, even when nobody reads the events
+	for i := 0; i < eventBufferSize*2; i++ {
+		bus.emit(Event{Type: FlowPaused})
+	}
+
+	if len(subscription.Events()) != eventBufferSize {
+		t.Errorf("buffered %d events, want %d", len(subscription.Events()), eventBufferSize)
+	}
+
+	subscription.Unsubscribe()
+	for range subscription.Events() {
+	}
+
+	// Unsubscribed subscriptions no longer receive events
+	bus.emit(Event{Type: FlowResumed})
+}
@@ -16,7 +16,7 @@ func main() {
 	connectionConfig := alice.CreateConfig(
 		"guest",
 		"guest",
-		"localhost:5672",
+		"localhost",
 		5672,
 		true,
 		time.Second*10,
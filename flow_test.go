@@ -0,0 +1,83 @@
+package alice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// createFlowTestProducer creates an available producer without a channel, using the given flow control policy
+func createFlowTestProducer(t *testing.T, policy FlowControlPolicy) *RabbitProducer {
+	config := CreateProducerConfig()
+	config.SetFlowControlPolicy(policy)
+
+	p := newTestProducer(t, config)
+	p.available = true
+	return p
+}
+
+func TestFlowState(t *testing.T) {
+	p := createFlowTestProducer(t, BlockDuringFlowControl)
+	if !p.FlowState().Active() {
+		t.Fatal("expected a new producer to be allowed to publish")
+	}
+
+	p.flowPaused = true
+	p.conn.setBlocked(nil, amqp.Blocking{Active: true, Reason: "low on memory"})
+
+	want := FlowState{Paused: true, Blocked: true, Reason: "low on memory"}
+	if state := p.FlowState(); state != want {
+		t.Errorf("flow state = %+v, want %+v", state, want)
+	}
+
+	p.resumeFlow()
+	p.conn.setBlocked(nil, amqp.Blocking{Active: false})
+	if state := p.FlowState(); !state.Active() {
+		t.Errorf("flow state = %+v, want active", state)
+	}
+}
+
+func TestFailDuringFlowControl(t *testing.T) {
+	p := createFlowTestProducer(t, FailDuringFlowControl)
+
+	p.flowPaused = true
+	if err := p.Publish(context.Background(), []byte("paused"), "key", nil); err != ErrFlowPaused {
+		t.Errorf("err = %v, want %v", err, ErrFlowPaused)
+	}
+
+	p.resumeFlow()
+	p.conn.setBlocked(nil, amqp.Blocking{Active: true, Reason: "low on disk"})
+	if err := p.Publish(context.Background(), []byte("blocked"), "key", nil); err != ErrConnectionBlocked {
+		t.Errorf("err = %v, want %v", err, ErrConnectionBlocked)
+	}
+}
+
+func TestBlockDuringFlowControl(t *testing.T) {
+	p := createFlowTestProducer(t, BlockDuringFlowControl)
+	p.flowPaused = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := p.Publish(ctx, []byte("paused"), "key", nil); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Shutting down the producer wakes up held back publishers
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Publish(context.Background(), []byte("paused"), "key", nil)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	p.stop()
+
+	select {
+	case err := <-errs:
+		if err != ErrChannelClosed {
+			t.Errorf("err = %v, want %v", err, ErrChannelClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publisher was not woken up")
+	}
+}
@@ -5,5 +5,5 @@ go 1.16
 require (
 	github.com/rs/zerolog v1.26.1
 	github.com/streadway/amqp v1.0.0
-	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
 )
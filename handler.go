@@ -0,0 +1,110 @@
+package alice
+
+import (
+	"context"
+	"errors"
+
+	"github.com/streadway/amqp"
+)
+
+// Disposition determines how a delivery is acknowledged once its handler has finished
+type Disposition int
+
+const (
+	// Ack acknowledges the delivery
+	Ack Disposition = iota
+
+	// Nack negatively acknowledges the delivery without requeueing it, the broker dead-letters or drops it
+	Nack
+
+	// Requeue negatively acknowledges the delivery and puts it back on the queue
+	Requeue
+
+	// Reject rejects the delivery without requeueing it, the broker dead-letters or drops it
+	Reject
+
+	// Manual leaves acknowledging the delivery to the handler
+	Manual
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case Ack:
+		return "ack"
+	case Nack:
+		return "nack"
+	case Requeue:
+		return "requeue"
+	case Reject:
+		return "reject"
+	case Manual:
+		return "manual"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+Handler handles a delivery and reports the outcome
+	ctx: context.Context, the context of this delivery
+	delivery: amqp.Delivery, the received message
+	Returns nil to ack the delivery, an error created by WithDisposition to choose the acknowledgement, or any other error to use the consumer's error disposition
+*/
+type Handler func(ctx context.Context, delivery amqp.Delivery) error
+
+// DispositionError is an error which tells the consumer how to acknowledge the delivery that caused it
+type DispositionError struct {
+	Disposition Disposition // How the delivery should be acknowledged
+	Err         error       // The underlying error, may be nil
+}
+
+func (e *DispositionError) Error() string {
+	if e.Err == nil {
+		return "delivery handled with disposition " + e.Disposition.String()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *DispositionError) Unwrap() error {
+	return e.Err
+}
+
+// WithDisposition wraps an error so the consumer acknowledges the delivery with the given disposition
+// err may be nil, e.g. WithDisposition(nil, Manual) for a handler which acknowledged the delivery itself
+func WithDisposition(err error, disposition Disposition) error {
+	return &DispositionError{
+		Disposition: disposition,
+		Err:         err,
+	}
+}
+
+// dispositionOf determines how to acknowledge a delivery given the error returned by its handler
+func dispositionOf(err error, errorDisposition Disposition) Disposition {
+	if err == nil {
+		return Ack
+	}
+
+	var dispositionErr *DispositionError
+	if errors.As(err, &dispositionErr) {
+		return dispositionErr.Disposition
+	}
+
+	return errorDisposition
+}
+
+// acknowledge acknowledges a single delivery according to the disposition
+func acknowledge(delivery amqp.Delivery, disposition Disposition) error {
+	switch disposition {
+	case Ack:
+		return delivery.Ack(false)
+	case Nack:
+		return delivery.Nack(false, false)
+	case Requeue:
+		return delivery.Nack(false, true)
+	case Reject:
+		return delivery.Reject(false)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,28 @@
+package alice
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDispositionOf(t *testing.T) {
+	failure := errors.New("failure")
+
+	tests := []struct {
+		err  error
+		want Disposition
+	}{
+		{nil, Ack},
+		{failure, Nack},
+		{WithDisposition(failure, Requeue), Requeue},
+		{WithDisposition(nil, Manual), Manual},
+		{fmt.Errorf("wrapped: %w", WithDisposition(failure, Reject)), Reject},
+	}
+
+	for _, test := range tests {
+		if got := dispositionOf(test.err, Nack); got != test.want {
+			t.Errorf("dispositionOf(%v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
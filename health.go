@@ -0,0 +1,165 @@
+package alice
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthReport describes the state of a broker's connections and channels
+type HealthReport struct {
+	Healthy   bool              `json:"healthy"`                      // Whether every connection and channel is open
+	Consumer  *ConnectionHealth `json:"consumerConnection,omitempty"` // The consumer connection, nil if no consumer has been created
+	Producer  *ConnectionHealth `json:"producerConnection,omitempty"` // The producer connection, nil if no producer has been created
+	Consumers []ConsumerHealth  `json:"consumers"`                    // The channels of the consumers
+	Producers []ProducerHealth  `json:"producers"`                    // The channels of the producers
+}
+
+// ConnectionHealth describes the state of a consumer or producer connection
+type ConnectionHealth struct {
+	Open                  bool      `json:"open"`                         // Whether the connection is open
+	Node                  string    `json:"node"`                         // Address of the node the connection is (or was last) connected to
+	LastReconnect         time.Time `json:"lastReconnect"`                // When the connection was last (re-)established
+	SinceReconnectSeconds float64   `json:"sinceReconnectSeconds"`        // Seconds since the connection was last (re-)established
+	LastError             string    `json:"lastError,omitempty"`          // The last error the connection was closed with or failed to reconnect with
+	ReconnectExhausted    bool      `json:"reconnectExhausted,omitempty"` // Whether reconnecting has been given up on
+}
+
+// ConsumerHealth describes the state of a consumer's channel
+type ConsumerHealth struct {
+	Queue       string `json:"queue"`               // The queue the consumer consumes from
+	ConsumerTag string `json:"consumerTag"`         // The tag of the consumer
+	Open        bool   `json:"open"`                // Whether the channel is open
+	Closed      bool   `json:"shutdown,omitempty"`  // Whether the consumer has been shut down
+	LastError   string `json:"lastError,omitempty"` // The last error the channel was closed with or failed to re-open with
+}
+
+// ProducerHealth describes the state of a producer's channel
+type ProducerHealth struct {
+	Exchange  string `json:"exchange"`            // The exchange the producer produces to
+	Open      bool   `json:"open"`                // Whether the channel is open and ready for publishing
+	Closed    bool   `json:"shutdown,omitempty"`  // Whether the producer has been shut down
+	Buffered  int    `json:"buffered"`            // Number of spooled messages, see RabbitProducer.Spooled
+	LastError string `json:"lastError,omitempty"` // The last error the channel was closed with or failed to re-open with
+}
+
+// health reports the state of the connection
+func (c *connection) health() *ConnectionHealth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	h := &ConnectionHealth{
+		Open:               c.conn != nil && !c.conn.IsClosed(),
+		Node:               c.node,
+		LastReconnect:      c.connectedAt,
+		ReconnectExhausted: c.err != nil && c.err != ErrBrokerShutdown,
+	}
+	if !c.connectedAt.IsZero() {
+		h.SinceReconnectSeconds = time.Since(c.connectedAt).Seconds()
+	}
+	if c.lastErr != nil {
+		h.LastError = c.lastErr.Error()
+	}
+	return h
+}
+
+// health reports the state of the consumer's channel
+func (c *RabbitConsumer) health() ConsumerHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := ConsumerHealth{
+		Queue:       c.queue.name,
+		ConsumerTag: c.tag,
+		Open:        c.available,
+		Closed:      c.closed,
+	}
+	if c.lastErr != nil {
+		h.LastError = c.lastErr.Error()
+	}
+	return h
+}
+
+// health reports the state of the producer's channel
+// It does not take the publish mutex, so a publish held up by an outage or flow control does not hold up the report
+func (p *RabbitProducer) health() ProducerHealth {
+	p.stateMutex.Lock()
+	h := ProducerHealth{
+		Exchange: p.exchange.name,
+		Open:     p.available && !p.closed,
+		Closed:   p.closed,
+	}
+	if p.err != nil {
+		h.LastError = p.err.Error()
+	} else if p.lastErr != nil {
+		h.LastError = p.lastErr.Error()
+	}
+	p.stateMutex.Unlock()
+
+	// The spool store guards its own state
+	h.Buffered = p.spool.Len()
+	return h
+}
+
+/*
+Health reports the state of the broker's connections and of every consumer and producer channel
+	The broker is healthy when every connection is open and every channel which has not been shut down is open
+	Returns HealthReport
+*/
+func (b *RabbitBroker) Health() HealthReport {
+	b.mu.Lock()
+	consumerConn := b.consumerConn
+	producerConn := b.producerConn
+	consumers := b.consumers
+	producers := b.producers
+	closed := b.closed
+	b.mu.Unlock()
+
+	report := HealthReport{
+		Healthy:   !closed,
+		Consumers: make([]ConsumerHealth, 0, len(consumers)),
+		Producers: make([]ProducerHealth, 0, len(producers)),
+	}
+
+	if consumerConn != nil {
+		report.Consumer = consumerConn.health()
+		report.Healthy = report.Healthy && report.Consumer.Open
+	}
+	if producerConn != nil {
+		report.Producer = producerConn.health()
+		report.Healthy = report.Healthy && report.Producer.Open
+	}
+
+	for _, consumer := range consumers {
+		h := consumer.health()
+		report.Healthy = report.Healthy && (h.Open || h.Closed)
+		report.Consumers = append(report.Consumers, h)
+	}
+	for _, producer := range producers {
+		h := producer.health()
+		report.Healthy = report.Healthy && (h.Open || h.Closed)
+		report.Producers = append(report.Producers, h)
+	}
+
+	return report
+}
+
+/*
+HealthHandler creates an HTTP handler serving the broker's health report as JSON, e.g. for readiness probes
+	broker: Broker, the broker to report on
+	Responds with 200 OK when the broker is healthy and 503 Service Unavailable otherwise
+	Returns http.Handler
+*/
+func HealthHandler(broker Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := broker.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
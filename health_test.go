@@ -0,0 +1,81 @@
+package alice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	broker := CreateMockBroker()
+
+	recorder := httptest.NewRecorder()
+	HealthHandler(broker).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	var report HealthReport
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy {
+		t.Error("expected the broker to be healthy")
+	}
+
+	broker.Shutdown(context.Background())
+
+	recorder = httptest.NewRecorder()
+	HealthHandler(broker).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestConnectionHealth(t *testing.T) {
+	conn := newTestConnection(nil)
+	conn.setLastError(errors.New("connection refused"))
+
+	h := conn.health()
+	if h.Open {
+		t.Error("expected a connection which never connected to be closed")
+	}
+	if h.LastError != "connection refused" {
+		t.Errorf("last error = %q, want %q", h.LastError, "connection refused")
+	}
+	if h.ReconnectExhausted {
+		t.Error("expected reconnecting not to be exhausted")
+	}
+
+	conn.fail(ErrReconnectAttemptsExhausted)
+	if !conn.health().ReconnectExhausted {
+		t.Error("expected reconnecting to be exhausted")
+	}
+}
+
+func TestProducerHealthDuringPublish(t *testing.T) {
+	p := newTestProducer(t, nil)
+	p.available = true
+
+	// A publish holds the publish mutex, e.g. while writing to a blocked socket
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+
+	reports := make(chan ProducerHealth, 1)
+	go func() {
+		reports <- p.health()
+	}()
+
+	select {
+	case h := <-reports:
+		if !h.Open {
+			t.Error("expected the producer to be open")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("health report waited for the publish")
+	}
+}
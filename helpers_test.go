@@ -0,0 +1,254 @@
+package alice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// newTestConnection creates a connection which is never dialed, using the given config or the default config if nil
+func newTestConnection(config *ConnectionConfig) *connection {
+	if config == nil {
+		config = CreateConfig("guest", "guest", "localhost", 5672, false, 0)
+	}
+
+	var dials uint32
+	return newConnection(*config, &dials, newEventBus(CreateNopLogger()))
+}
+
+// newTestProducer creates a producer without a channel, as if its channel was lost, using the given config or the default config if nil
+// The producer is stopped once the test has finished, which wakes up publishes it still holds back
+func newTestProducer(t *testing.T, config *ProducerConfig) *RabbitProducer {
+	t.Helper()
+	if config == nil {
+		config = CreateProducerConfig()
+	}
+
+	exchange, _ := CreateDefaultExchange("test-exchange", Direct)
+	p := newProducer(newTestConnection(nil), exchange, config)
+	t.Cleanup(func() { p.stop() })
+	return p
+}
+
+// connectFakeBroker connects the producer to a fake broker and sets up its channel, as recovering from an outage would
+// Returns the messages published to the fake broker
+func connectFakeBroker(t *testing.T, p *RabbitProducer) <-chan fakeMessage {
+	t.Helper()
+	client, server := net.Pipe()
+	published := make(chan fakeMessage, 10)
+	go serveFakeAMQP(server, published)
+
+	conn, err := amqp.Open(client, amqp.Config{SASL: []amqp.Authentication{&amqp.PlainAuth{Username: "guest", Password: "guest"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	p.conn.setConn(conn, "fake")
+	if err = p.setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shut down the producer before the connection, so it does not try to recover from the connection closing
+	t.Cleanup(func() { p.Shutdown() })
+	return published
+}
+
+// fakeUnroutableKey is the routing key the fake broker cannot route messages with
+const fakeUnroutableKey = "unroutable"
+
+// fakeMessage is a message published to the fake broker
+type fakeMessage struct {
+	routingKey string            // The routing key the message was published with
+	headers    map[string]string // The string headers of the message, nil if it was published without headers
+	messageID  string            // The message ID property of the message
+	body       string            // The body of the message
+}
+
+// fakeChannel is the state of a channel on the fake broker
+type fakeChannel struct {
+	confirming  bool         // Whether the channel is in confirm mode
+	deliveryTag uint64       // Delivery tag of the last message published in confirm mode
+	exchange    string       // The exchange the message being published is published to
+	routingKey  string       // The routing key of the message being published
+	mandatory   bool         // Whether the message being published is mandatory
+	header      []byte       // The content header of the message being published
+	size        uint64       // The body size of the message being published
+	body        bytes.Buffer // The part of the body received so far
+}
+
+// serveFakeAMQP speaks just enough AMQP 0-9-1 on conn for a client to connect, open channels, declare exchanges and publish
+// Channels can be put into confirm mode, mandatory messages published with fakeUnroutableKey are returned before they are acked
+// The messages published are sent to published, in order
+func serveFakeAMQP(conn net.Conn, published chan<- fakeMessage) {
+	defer conn.Close()
+
+	writeFrame := func(kind byte, channel uint16, payload []byte) error {
+		frame := make([]byte, 7, 8+len(payload))
+		frame[0] = kind
+		binary.BigEndian.PutUint16(frame[1:3], channel)
+		binary.BigEndian.PutUint32(frame[3:7], uint32(len(payload)))
+		frame = append(append(frame, payload...), 0xce)
+		_, err := conn.Write(frame)
+		return err
+	}
+	writeMethod := func(channel uint16, class uint16, method uint16, args ...byte) error {
+		payload := make([]byte, 4, 4+len(args))
+		binary.BigEndian.PutUint16(payload[0:2], class)
+		binary.BigEndian.PutUint16(payload[2:4], method)
+		return writeFrame(1, channel, append(payload, args...))
+	}
+
+	// Protocol header, then connection.start: version 0-9, no server properties, PLAIN authentication and the en_US locale
+	if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+		return
+	}
+	if writeMethod(0, 10, 10, 0, 9, 0, 0, 0, 0, 0, 0, 0, 5, 'P', 'L', 'A', 'I', 'N', 0, 0, 0, 5, 'e', 'n', '_', 'U', 'S') != nil {
+		return
+	}
+
+	// publish hands a completely received message to the test, then returns and confirms it
+	publish := func(channel uint16, state *fakeChannel) error {
+		headers, messageID := fakeProperties(state.header[12:])
+		published <- fakeMessage{
+			routingKey: state.routingKey,
+			headers:    headers,
+			messageID:  messageID,
+			body:       state.body.String(),
+		}
+		if !state.confirming {
+			return nil
+		}
+
+		// basic.return with reply code 312, followed by the message, then basic.ack
+		if state.mandatory && state.routingKey == fakeUnroutableKey {
+			args := []byte{0x01, 0x38}
+			for _, value := range []string{"NO_ROUTE", state.exchange, state.routingKey} {
+				args = append(append(args, byte(len(value))), value...)
+			}
+			if err := writeMethod(channel, 60, 50, args...); err != nil {
+				return err
+			}
+			if err := writeFrame(2, channel, state.header); err != nil {
+				return err
+			}
+			if err := writeFrame(3, channel, state.body.Bytes()); err != nil {
+				return err
+			}
+		}
+		state.deliveryTag++
+		ack := make([]byte, 9)
+		binary.BigEndian.PutUint64(ack, state.deliveryTag)
+		return writeMethod(channel, 60, 80, ack...)
+	}
+
+	channels := make(map[uint16]*fakeChannel)
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		channel := binary.BigEndian.Uint16(header[1:3])
+		payload := make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		payload = payload[:len(payload)-1]
+
+		var err error
+		switch header[0] {
+		case 1: // Method
+			switch class, method := binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4]); {
+			case class == 10 && method == 11: // connection.start-ok, reply with connection.tune: no channel limit, 128 KiB frames and no heartbeats
+				err = writeMethod(0, 10, 30, 0, 0, 0, 2, 0, 0, 0, 0)
+			case class == 10 && method == 40: // connection.open
+				err = writeMethod(0, 10, 41, 0)
+			case class == 10 && method == 50: // connection.close
+				writeMethod(0, 10, 51)
+				return
+			case class == 20 && method == 10: // channel.open
+				channels[channel] = &fakeChannel{}
+				err = writeMethod(channel, 20, 11, 0, 0, 0, 0)
+			case class == 20 && method == 40: // channel.close
+				delete(channels, channel)
+				err = writeMethod(channel, 20, 41)
+			case class == 40 && method == 10: // exchange.declare
+				err = writeMethod(channel, 40, 11)
+			case class == 85 && method == 10: // confirm.select
+				channels[channel].confirming = true
+				err = writeMethod(channel, 85, 11)
+			case class == 60 && method == 40: // basic.publish, followed by the content header and body
+				state := channels[channel]
+				args := payload[6:]
+				state.exchange, args = string(args[1:1+args[0]]), args[1+args[0]:]
+				state.routingKey, args = string(args[1:1+args[0]]), args[1+args[0]:]
+				state.mandatory = args[0]&1 != 0
+				state.body.Reset()
+			}
+
+		case 2: // Content header
+			state := channels[channel]
+			state.header = payload
+			state.size = binary.BigEndian.Uint64(payload[4:12])
+			if state.size == 0 {
+				err = publish(channel, state)
+			}
+
+		case 3: // Content body
+			state := channels[channel]
+			state.body.Write(payload)
+			if uint64(state.body.Len()) == state.size {
+				err = publish(channel, state)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// fakeProperties reads the string headers and the message ID from the properties of a content header
+// Reading the headers stops at the first header which is not a string
+func fakeProperties(properties []byte) (map[string]string, string) {
+	flags := binary.BigEndian.Uint16(properties[0:2])
+	properties = properties[2:]
+	shortString := func() string {
+		value := string(properties[1 : 1+properties[0]])
+		properties = properties[1+properties[0]:]
+		return value
+	}
+
+	var headers map[string]string
+	var messageID string
+	for bit := uint(15); bit >= 7; bit-- {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		switch bit {
+		case 13: // headers
+			size := binary.BigEndian.Uint32(properties[0:4])
+			table := properties[4 : 4+size]
+			properties = properties[4+size:]
+
+			headers = make(map[string]string)
+			for len(table) > 0 && table[1+table[0]] == 'S' {
+				key := string(table[1 : 1+table[0]])
+				table = table[2+table[0]:]
+				length := binary.BigEndian.Uint32(table[0:4])
+				headers[key] = string(table[4 : 4+length])
+				table = table[4+length:]
+			}
+		case 12, 11: // delivery-mode, priority
+			properties = properties[1:]
+		case 7: // message-id
+			messageID = shortString()
+		default: // content-type, content-encoding, correlation-id, reply-to, expiration
+			shortString()
+		}
+	}
+	return headers, messageID
+}
@@ -1,21 +1,36 @@
 package alice
 
-import "github.com/streadway/amqp"
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
 
 // A Broker models a broker
 type Broker interface {
 	CreateConsumer(queue *Queue, bindingKey string, consumerTag string) (Consumer, error)
+	CreateConsumerWithConfig(queue *Queue, bindingKey string, consumerTag string, config *ConsumerConfig) (Consumer, error)
 	CreateProducer(exchange *Exchange) (Producer, error)
+	CreateProducerWithConfig(exchange *Exchange, config *ProducerConfig) (Producer, error)
+	Subscribe(types ...EventType) *Subscription
+	Health() HealthReport
+	Shutdown(ctx context.Context) error
 }
 
 // A Consumer models a broker consumer
 type Consumer interface {
 	ConsumeMessages(args amqp.Table, autoAck bool, messageHandler func(amqp.Delivery))
+	Consume(args amqp.Table, handler Handler)
 	Shutdown() error
 }
 
 // A Producer models a broker producer
 type Producer interface {
 	PublishMessage(msg []byte, key *string, headers *amqp.Table)
+	Publish(ctx context.Context, msg []byte, key string, headers amqp.Table) error
+	PublishWithOptions(ctx context.Context, msg []byte, key string, headers amqp.Table, options *PublishOptions) error
+	PublishWithConfirmation(msg []byte, key string, headers amqp.Table) (*Confirmation, error)
+	PublishBatch(ctx context.Context, messages []*Message) error
+	FlowState() FlowState
 	Shutdown() error
 }
@@ -0,0 +1,137 @@
+package alice
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+const (
+	// TraceLevel is used for messages about every single message handled
+	TraceLevel LogLevel = -1
+	// DebugLevel is used for messages useful while debugging
+	DebugLevel LogLevel = 0
+	// InfoLevel is used for state changes during normal operation
+	InfoLevel LogLevel = 1
+	// WarnLevel is used for problems Alice recovers from by itself
+	WarnLevel LogLevel = 2
+	// ErrorLevel is used for failures
+	ErrorLevel LogLevel = 3
+	// OffLevel turns logging off when passed to ConnectionConfig.SetLogLevel
+	OffLevel LogLevel = 127
+)
+
+// String returns the name of the level
+func (l LogLevel) String() string {
+	switch l {
+	case TraceLevel:
+		return "trace"
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return "off"
+	}
+}
+
+// A Logger receives the log messages of Alice
+type Logger interface {
+	// Log logs a message with alternating keys and values describing it, keys are strings
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// zerologLogger is a Logger writing to a zerolog logger
+type zerologLogger struct {
+	logger *zerolog.Logger // The logger written to
+}
+
+// CreateZerologLogger creates a Logger writing to the given zerolog logger
+func CreateZerologLogger(logger zerolog.Logger) Logger {
+	return zerologLogger{logger: &logger}
+}
+
+// Log logs the message on the zerolog level matching the level
+func (l zerologLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	var event *zerolog.Event
+	switch level {
+	case TraceLevel:
+		event = l.logger.Trace()
+	case DebugLevel:
+		event = l.logger.Debug()
+	case InfoLevel:
+		event = l.logger.Info()
+	case WarnLevel:
+		event = l.logger.Warn()
+	default:
+		event = l.logger.Error()
+	}
+
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		switch value := keyvals[i+1].(type) {
+		case nil:
+			continue
+		case error:
+			event = event.AnErr(key, value)
+		case string:
+			event = event.Str(key, value)
+		case int:
+			event = event.Int(key, value)
+		default:
+			event = event.Interface(key, value)
+		}
+	}
+
+	event.Msg(msg)
+}
+
+// nopLogger is a Logger discarding every message
+type nopLogger struct{}
+
+// CreateNopLogger creates a Logger discarding every message
+func CreateNopLogger() Logger {
+	return nopLogger{}
+}
+
+// Log discards the message
+func (nopLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {}
+
+// CreateDefaultLogger creates the Logger brokers use when none is set
+// It writes to the global zerolog logger and drops the messages below the level set with SetLogLevel
+func CreateDefaultLogger() Logger {
+	return newLogger(nil, defaultLogLevel())
+}
+
+// defaultLogger writes to the global zerolog logger, without modifying it
+var defaultLogger Logger = zerologLogger{logger: &log.Logger}
+
+// leveledLogger drops the messages below its level
+type leveledLogger struct {
+	logger Logger   // The logger messages at or above the level are passed to
+	level  LogLevel // The minimum level of the messages passed on
+}
+
+// Log passes the message on if its level is enabled
+func (l leveledLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.logger.Log(level, msg, keyvals...)
+}
+
+// newLogger wraps a logger so it drops the messages below the given level, nil uses the global zerolog logger
+func newLogger(logger Logger, level LogLevel) Logger {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	return leveledLogger{logger: logger, level: level}
+}
@@ -0,0 +1,38 @@
+//go:build go1.21
+// +build go1.21
+
+package alice
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger is a Logger writing to a log/slog logger
+type slogLogger struct {
+	logger *slog.Logger // The logger written to
+}
+
+// CreateSlogLogger creates a Logger writing to the given log/slog logger, Alice's trace level maps to slog.LevelDebug - 4
+func CreateSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger}
+}
+
+// Log logs the message on the slog level matching the level
+func (l slogLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	var slogLevel slog.Level
+	switch level {
+	case TraceLevel:
+		slogLevel = slog.LevelDebug - 4
+	case DebugLevel:
+		slogLevel = slog.LevelDebug
+	case InfoLevel:
+		slogLevel = slog.LevelInfo
+	case WarnLevel:
+		slogLevel = slog.LevelWarn
+	default:
+		slogLevel = slog.LevelError
+	}
+
+	l.logger.Log(context.Background(), slogLevel, msg, keyvals...)
+}
@@ -0,0 +1,27 @@
+//go:build go1.21
+// +build go1.21
+
+package alice
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := CreateSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	logger.Log(TraceLevel, "received message")
+	logger.Log(InfoLevel, "created producer", "exchange", "orders")
+
+	out := buf.String()
+	if strings.Contains(out, "received message") {
+		t.Errorf("output %s contains the trace message", out)
+	}
+	if !strings.Contains(out, "level=INFO") || !strings.Contains(out, "exchange=orders") {
+		t.Errorf("output %s does not contain the info message", out)
+	}
+}
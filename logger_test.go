@@ -0,0 +1,108 @@
+package alice
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// recordingLogger records the messages logged to it
+type recordingLogger struct {
+	messages []string
+	keyvals  [][]interface{}
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	l.messages = append(l.messages, level.String()+" "+msg)
+	l.keyvals = append(l.keyvals, keyvals)
+}
+
+// fields returns the keys and values of the first message logged with the given level and text, nil if it was not logged
+func (l *recordingLogger) fields(message string) map[string]interface{} {
+	for i, logged := range l.messages {
+		if logged != message {
+			continue
+		}
+
+		fields := make(map[string]interface{})
+		for j := 0; j+1 < len(l.keyvals[i]); j += 2 {
+			fields[l.keyvals[i][j].(string)] = l.keyvals[i][j+1]
+		}
+		return fields
+	}
+	return nil
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer SetLogLevel(int(TraceLevel))
+
+	recorder := &recordingLogger{}
+	config := CreateConfig("guest", "guest", "localhost", 5672, false, 0)
+	config.SetLogger(recorder)
+
+	SetLogLevel(int(WarnLevel))
+	logger := config.logger()
+	logger.Log(InfoLevel, "dropped")
+	logger.Log(ErrorLevel, "kept")
+
+	// The level is fixed once the broker's logger is created
+	SetLogLevel(-2)
+	logger.Log(ErrorLevel, "kept")
+	config.logger().Log(ErrorLevel, "dropped")
+
+	if want := []string{"error kept", "error kept"}; !reflect.DeepEqual(recorder.messages, want) {
+		t.Errorf("messages = %v, want %v", recorder.messages, want)
+	}
+}
+
+func TestConfigLogLevel(t *testing.T) {
+	defer SetLogLevel(int(TraceLevel))
+	SetLogLevel(int(ErrorLevel))
+
+	// Brokers with their own level do not affect each other, nor follow the package level
+	verbose := &recordingLogger{}
+	verboseConfig := CreateConfig("guest", "guest", "localhost", 5672, false, 0)
+	verboseConfig.SetLogger(verbose)
+	verboseConfig.SetLogLevel(DebugLevel)
+
+	quiet := &recordingLogger{}
+	quietConfig := CreateConfig("guest", "guest", "localhost", 5672, false, 0)
+	quietConfig.SetLogger(quiet)
+	quietConfig.SetLogLevel(OffLevel)
+
+	verboseLogger := verboseConfig.logger()
+	quietLogger := quietConfig.logger()
+	for _, logger := range []Logger{verboseLogger, quietLogger} {
+		logger.Log(TraceLevel, "dropped")
+		logger.Log(DebugLevel, "debugging")
+		logger.Log(ErrorLevel, "failed")
+	}
+
+	if want := []string{"debug debugging", "error failed"}; !reflect.DeepEqual(verbose.messages, want) {
+		t.Errorf("verbose messages = %v, want %v", verbose.messages, want)
+	}
+	if len(quiet.messages) != 0 {
+		t.Errorf("quiet messages = %v, want none", quiet.messages)
+	}
+}
+
+func TestZerologLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := CreateZerologLogger(zerolog.New(&buf))
+
+	logger.Log(WarnLevel, "connection was closed", "err", errors.New("EOF"), "connType", "producer", "attempt", 2, "missing", nil)
+
+	out := buf.String()
+	for _, want := range []string{`"level":"warn"`, `"err":"EOF"`, `"connType":"producer"`, `"attempt":2`, `"message":"connection was closed"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output %s does not contain %s", out, want)
+		}
+	}
+	if strings.Contains(out, "missing") {
+		t.Errorf("output %s contains the nil value", out)
+	}
+}
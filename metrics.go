@@ -0,0 +1,41 @@
+package alice
+
+import (
+	"time"
+)
+
+// A MetricsCollector receives the measurements of a broker's producers, consumers and connections
+// Its methods are called concurrently and must not block
+type MetricsCollector interface {
+	// MessagePublished is called for every message published, err is nil if the message was handed to the broker or buffered
+	MessagePublished(exchange string, routingKey string, err error)
+	// PublishConfirmed is called for every broker ack or nack of a message published in confirm mode
+	// latency is the time between publishing the message and receiving the confirmation
+	PublishConfirmed(exchange string, routingKey string, acked bool, latency time.Duration)
+	// MessageDelivered is called for every message delivered to a consumer, routingKey is the consumer's binding key
+	MessageDelivered(queue string, routingKey string, consumerTag string)
+	// HandlerStarted is called when a message handler starts running
+	HandlerStarted(queue string, routingKey string, consumerTag string)
+	// MessageHandled is called when a message handler finished and the message was acknowledged with the given disposition
+	// duration is the time the handler took
+	MessageHandled(queue string, routingKey string, consumerTag string, disposition Disposition, duration time.Duration)
+	// ReconnectAttempted is called for every attempt to re-establish a consumer or producer connection, err is nil if it succeeded
+	ReconnectAttempted(connType string, err error)
+}
+
+// nopMetrics is a MetricsCollector discarding every measurement
+type nopMetrics struct{}
+
+func (nopMetrics) MessagePublished(exchange string, routingKey string, err error) {}
+
+func (nopMetrics) PublishConfirmed(exchange string, routingKey string, acked bool, latency time.Duration) {
+}
+
+func (nopMetrics) MessageDelivered(queue string, routingKey string, consumerTag string) {}
+
+func (nopMetrics) HandlerStarted(queue string, routingKey string, consumerTag string) {}
+
+func (nopMetrics) MessageHandled(queue string, routingKey string, consumerTag string, disposition Disposition, duration time.Duration) {
+}
+
+func (nopMetrics) ReconnectAttempted(connType string, err error) {}
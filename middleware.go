@@ -0,0 +1,77 @@
+package alice
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// Middleware wraps a message handler with cross-cutting behaviour, e.g. logging, timing, validation or deduplication
+// Register middleware for every consumer of a broker with ConnectionConfig.AddConsumerMiddleware,
+// for a single consumer with ConsumerConfig.AddMiddleware, or for a single handler with Chain
+type Middleware func(next Handler) Handler
+
+/*
+Chain wraps a handler with middleware
+	handler: Handler, the handler to wrap
+	middleware: ...Middleware, the middleware to wrap the handler with, the first one is the outermost
+	Returns the wrapped Handler
+*/
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// PanicError is the error a message handler panic is turned into by the Recover middleware
+type PanicError struct {
+	Value interface{} // The value the handler panicked with
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("message handler panicked: %v", e.Value)
+}
+
+// Recover creates a middleware turning handler panics into a *PanicError, acknowledged with the given disposition
+// Every consumer handler is wrapped with it as the outermost middleware, using the consumer's panic disposition
+func Recover(disposition Disposition) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = WithDisposition(&PanicError{Value: r}, disposition)
+				}
+			}()
+
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// A Message is a message on its way to the broker, passed through the publish middleware
+type Message struct {
+	Body       []byte          // The message body
+	RoutingKey string          // The routing key the message is published with
+	Headers    amqp.Table      // The message headers
+	Options    *PublishOptions // The options the message is published with, shared with the producer so replace rather than modify them
+}
+
+// PublishFunc publishes a message, returning its confirmation when the producer is in confirm mode
+type PublishFunc func(ctx context.Context, message *Message) (*Confirmation, error)
+
+// PublishMiddleware wraps the publishing of messages with cross-cutting behaviour, e.g. validation, enrichment or logging
+// Register publish middleware for every producer of a broker with ConnectionConfig.AddPublishMiddleware,
+// or for a single producer with ProducerConfig.AddMiddleware
+type PublishMiddleware func(next PublishFunc) PublishFunc
+
+// wrapPublish wraps a publish function with the broker's publish middleware and the producer's own middleware
+// The first middleware is the outermost
+func wrapPublish(publish PublishFunc, brokerMiddleware []PublishMiddleware, config *ProducerConfig) PublishFunc {
+	middleware := append(append([]PublishMiddleware{}, brokerMiddleware...), config.middleware...)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		publish = middleware[i](publish)
+	}
+	return publish
+}
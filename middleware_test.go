@@ -0,0 +1,175 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// recordingMiddleware appends its name to calls before calling the next handler
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) error {
+			*calls = append(*calls, name)
+			return next(ctx, delivery)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	handler := Chain(func(ctx context.Context, delivery amqp.Delivery) error {
+		calls = append(calls, "handler")
+		return nil
+	}, recordingMiddleware("first", &calls), recordingMiddleware("second", &calls))
+
+	handler(context.Background(), amqp.Delivery{})
+
+	want := []string{"first", "second", "handler"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	handler := Chain(func(ctx context.Context, delivery amqp.Delivery) error {
+		panic("boom")
+	}, Recover(Reject))
+
+	err := handler(context.Background(), amqp.Delivery{})
+
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+		t.Fatalf("err = %v, want a PanicError", err)
+	}
+	if d := dispositionOf(err, Nack); d != Reject {
+		t.Errorf("disposition = %s, want %s", d, Reject)
+	}
+}
+
+func TestWrapHandler(t *testing.T) {
+	var calls []string
+	config := CreateConsumerConfig()
+	config.SetPanicDisposition(Requeue)
+	config.AddMiddleware(recordingMiddleware("consumer", &calls))
+
+	handler := wrapHandler(func(ctx context.Context, delivery amqp.Delivery) error {
+		calls = append(calls, "handler")
+		panic("boom")
+	}, []Middleware{recordingMiddleware("broker", &calls)}, config)
+
+	err := handler(context.Background(), amqp.Delivery{})
+
+	want := []string{"broker", "consumer", "handler"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if d := dispositionOf(err, Nack); d != Requeue {
+		t.Errorf("disposition = %s, want %s", d, Requeue)
+	}
+}
+
+func TestLegacyHandlerPanic(t *testing.T) {
+	handler := legacyHandler(false, func(delivery amqp.Delivery) {
+		panic("boom")
+	})
+
+	err := handler(context.Background(), amqp.Delivery{})
+
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		t.Errorf("err = %v, want a PanicError", err)
+	}
+	if d := dispositionOf(err, Nack); d != Manual {
+		t.Errorf("disposition = %s, want %s", d, Manual)
+	}
+}
+
+func TestWrapPublish(t *testing.T) {
+	var calls []string
+	recording := func(name string) PublishMiddleware {
+		return func(next PublishFunc) PublishFunc {
+			return func(ctx context.Context, message *Message) (*Confirmation, error) {
+				calls = append(calls, name)
+				message.Headers = amqp.Table{"enriched-by": name}
+				return next(ctx, message)
+			}
+		}
+	}
+
+	config := CreateProducerConfig()
+	config.AddMiddleware(recording("producer"))
+
+	var published *Message
+	publish := wrapPublish(func(ctx context.Context, message *Message) (*Confirmation, error) {
+		published = message
+		return nil, nil
+	}, []PublishMiddleware{recording("broker")}, config)
+
+	publish(context.Background(), &Message{Body: []byte("hello")})
+
+	want := []string{"broker", "producer"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if published.Headers["enriched-by"] != "producer" {
+		t.Errorf("published headers = %v", published.Headers)
+	}
+}
+
+func TestMockMiddleware(t *testing.T) {
+	broker := CreateMockBroker()
+	exchange, _ := CreateExchange("test-exchange", Direct, false, true, false, false, nil)
+	queue := CreateQueue(exchange, "test-queue", false, false, true, false, nil)
+
+	rejected := errors.New("rejected by middleware")
+	producerConfig := CreateProducerConfig()
+	producerConfig.AddMiddleware(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, message *Message) (*Confirmation, error) {
+			if len(message.Body) == 0 {
+				return nil, rejected
+			}
+			return next(ctx, message)
+		}
+	})
+
+	handled := make(chan string, 1)
+	consumerConfig := CreateConsumerConfig()
+	consumerConfig.AddMiddleware(func(next Handler) Handler {
+		return func(ctx context.Context, delivery amqp.Delivery) error {
+			handled <- string(delivery.Body)
+			return next(ctx, delivery)
+		}
+	})
+
+	c, _ := broker.CreateConsumerWithConfig(queue, "key", "", consumerConfig)
+	p, _ := broker.CreateProducerWithConfig(exchange, producerConfig)
+
+	go c.Consume(nil, func(ctx context.Context, delivery amqp.Delivery) error {
+		panic("boom")
+	})
+
+	if err := p.Publish(context.Background(), nil, "key", nil); err != rejected {
+		t.Errorf("err = %v, want %v", err, rejected)
+	}
+	if err := p.Publish(context.Background(), []byte("hello"), "key", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-handled:
+		if body != "hello" {
+			t.Errorf("handled %q, want %q", body, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not handled")
+	}
+
+	if err := broker.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
@@ -1,36 +1,165 @@
 package alice
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	"github.com/streadway/amqp"
 )
 
 // A MockProducer implements the Producer interface
 type MockProducer struct {
-	exchange *Exchange
-	broker   *MockBroker
+	exchange     *Exchange
+	broker       *MockBroker
+	config       *ProducerConfig
+	deliveryTag  uint64
+	publishChain PublishFunc // Delivers messages through the producer's publish middleware
 }
 
 // PublishMessage publishes a message
 func (p *MockProducer) PublishMessage(msg []byte, key *string, headers *amqp.Table) {
+	var routingKey string
+	if key != nil {
+		routingKey = *key
+	}
+
+	var table amqp.Table
+	if headers != nil {
+		table = *headers
+	}
+
+	p.Publish(context.Background(), msg, routingKey, table)
+}
+
+// Publish publishes a message, blocking until every bound queue received it or the context is done (mock)
+func (p *MockProducer) Publish(ctx context.Context, msg []byte, key string, headers amqp.Table) error {
+	return p.PublishWithOptions(ctx, msg, key, headers, nil)
+}
+
+// PublishWithOptions publishes a message with the given options, nil uses the producer defaults (mock)
+func (p *MockProducer) PublishWithOptions(ctx context.Context, msg []byte, key string, headers amqp.Table, options *PublishOptions) error {
+	if p.broker.isClosed() {
+		return ErrBrokerShutdown
+	}
+
+	if options == nil {
+		options = p.config.publishOptions
+	}
+
+	_, err := p.publishChain(ctx, &Message{
+		Body:       msg,
+		RoutingKey: key,
+		Headers:    headers,
+		Options:    options,
+	})
+	return err
+}
+
+// deliver sends a message to the queues bound with its routing key, it is the innermost PublishFunc of the publish middleware (mock)
+func (p *MockProducer) deliver(ctx context.Context, message *Message) (*Confirmation, error) {
+	msg, key, headers, options := message.Body, message.RoutingKey, message.Headers, message.Options
+
+	// Hold the read lock until delivered, so shutdown does not close the queues meanwhile
+	p.broker.mu.RLock()
+	defer p.broker.mu.RUnlock()
+	if p.broker.closed {
+		return nil, ErrBrokerShutdown
+	}
+
 	// Find the queues this message was meant for
 	var queuesToSendTo []*Queue = make([]*Queue, 0, 10)
 	for _, q := range p.broker.exchanges[p.exchange] {
-		if q.bindingKey == *key {
+		if q.bindingKey == key {
 			queuesToSendTo = append(queuesToSendTo, q)
 		}
 	}
 
+	publishing := options.publishing(msg, headers)
+
+	// Return mandatory messages which cannot be routed to any queue
+	if len(queuesToSendTo) == 0 && options.mandatory {
+		returned := amqp.Return{
+			ReplyCode:   amqp.NoRoute,
+			ReplyText:   "NO_ROUTE",
+			Exchange:    p.exchange.name,
+			RoutingKey:  key,
+			Headers:     publishing.Headers,
+			ContentType: publishing.ContentType,
+			MessageId:   publishing.MessageId,
+			Body:        publishing.Body,
+		}
+		p.broker.events.emit(Event{Type: MessageReturned, ConnType: "producer", Exchange: p.exchange.name, Return: &returned})
+		if p.config.returnHandler != nil {
+			go p.config.returnHandler(returned)
+		}
+
+		if p.config.confirmMode {
+			return nil, fmt.Errorf("%w: %s", ErrUnroutable, returned.ReplyText)
+		}
+		return nil, nil
+	}
 	delivery := amqp.Delivery{
-		Headers:         *headers,
-		ContentType:     "",
-		ContentEncoding: "",
-		Body:            msg,
+		Headers:         publishing.Headers,
+		ContentType:     publishing.ContentType,
+		ContentEncoding: publishing.ContentEncoding,
+		DeliveryMode:    publishing.DeliveryMode,
+		Priority:        publishing.Priority,
+		CorrelationId:   publishing.CorrelationId,
+		ReplyTo:         publishing.ReplyTo,
+		Expiration:      publishing.Expiration,
+		MessageId:       publishing.MessageId,
+		Timestamp:       publishing.Timestamp,
+		Type:            publishing.Type,
+		UserId:          publishing.UserId,
+		AppId:           publishing.AppId,
+		Exchange:        p.exchange.name,
+		RoutingKey:      key,
+		Body:            publishing.Body,
 	}
 
 	// Send message to the queues
 	for _, q := range queuesToSendTo {
-		p.broker.Messages[q] <- delivery
+		select {
+		case p.broker.Messages[q] <- delivery:
+		case <-p.broker.done:
+			return nil, ErrBrokerShutdown
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, nil
+}
+
+// PublishWithConfirmation publishes a message and returns an acked confirmation (mock)
+func (p *MockProducer) PublishWithConfirmation(msg []byte, key string, headers amqp.Table) (*Confirmation, error) {
+	if !p.config.confirmMode {
+		return nil, ErrConfirmModeDisabled
 	}
+
+	// Like the broker, unroutable messages are reported through their confirmation
+	err := p.Publish(context.Background(), msg, key, headers)
+	if err != nil && !errors.Is(err, ErrUnroutable) {
+		return nil, err
+	}
+
+	p.deliveryTag++
+	confirmation := newConfirmation(p.deliveryTag)
+	confirmation.resolve(err)
+	return confirmation, nil
+}
+
+// PublishBatch publishes a batch of messages, reporting the messages which failed in a *BatchError (mock)
+func (p *MockProducer) PublishBatch(ctx context.Context, messages []*Message) error {
+	return publishBatch(ctx, messages, func(ctx context.Context, message *Message) (*Confirmation, error) {
+		return nil, p.PublishWithOptions(ctx, message.Body, message.RoutingKey, message.Headers, message.Options)
+	})
+}
+
+// FlowState returns the flow state, the mock broker always allows publishing (mock)
+func (p *MockProducer) FlowState() FlowState {
+	return FlowState{}
 }
 
 // Shutdown shuts this producer down
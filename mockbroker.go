@@ -1,6 +1,9 @@
 package alice
 
 import (
+	"context"
+	"sync"
+
 	"github.com/streadway/amqp"
 )
 
@@ -8,6 +11,13 @@ import (
 type MockBroker struct {
 	exchanges map[*Exchange][]*Queue        // The exchanges bound to this broker, with their bound queues
 	Messages  map[*Queue]chan amqp.Delivery // The messages sent in a queue
+	log       Logger                        // The logger of the broker
+	events    *eventBus                     // The bus the broker's events are emitted on
+	handlers  sync.WaitGroup                // Message handlers which are still running
+	mu        sync.RWMutex                  // Guards the exchanges, the messages and the field below, held for reading while delivering
+	closed    bool                          // Whether the broker has been shut down
+	done      chan struct{}                 // Closed on shutdown, wakes up blocked deliveries
+	shutdown  sync.Once                     // Shuts the broker down once
 }
 
 // CreateMockBroker creates a new MockBroker (mock)
@@ -15,31 +25,102 @@ func CreateMockBroker() Broker {
 	return &MockBroker{
 		exchanges: make(map[*Exchange][]*Queue),
 		Messages:  make(map[*Queue]chan amqp.Delivery),
+		log:       newLogger(nil, defaultLogLevel()),
+		events:    newEventBus(newLogger(nil, defaultLogLevel())),
+		done:      make(chan struct{}),
 	}
 }
 
 // CreateConsumer creates a new consumer (mock)
 func (b *MockBroker) CreateConsumer(queue *Queue, bindingKey string, consumerTag string) (Consumer, error) {
+	return b.CreateConsumerWithConfig(queue, bindingKey, consumerTag, DefaultConsumerConfig)
+}
+
+// CreateConsumerWithConfig creates a new consumer using the given configuration (mock)
+func (b *MockBroker) CreateConsumerWithConfig(queue *Queue, bindingKey string, consumerTag string, config *ConsumerConfig) (Consumer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBrokerShutdown
+	}
+
 	queue.bindingKey = bindingKey
 	c := &MockConsumer{
 		queue:            queue,
 		broker:           b,
+		config:           config,
 		ReceivedMessages: make([]amqp.Delivery, 0),
 	}
 
-	// Add this queue to this exchange
-	b.exchanges[queue.exchange] = append(b.exchanges[queue.exchange], queue)
-	b.Messages[queue] = make(chan amqp.Delivery, 0)
+	// Add this queue to this exchange, consumers of the same queue share its messages
+	if _, ok := b.Messages[queue]; !ok {
+		b.exchanges[queue.exchange] = append(b.exchanges[queue.exchange], queue)
+		b.Messages[queue] = make(chan amqp.Delivery, 0)
+	}
 
 	return c, nil
 }
 
 // CreateProducer creates a new producer (mock)
 func (b *MockBroker) CreateProducer(exchange *Exchange) (Producer, error) {
+	return b.CreateProducerWithConfig(exchange, DefaultProducerConfig)
+}
+
+// CreateProducerWithConfig creates a new producer using the given configuration (mock)
+func (b *MockBroker) CreateProducerWithConfig(exchange *Exchange, config *ProducerConfig) (Producer, error) {
+	if b.isClosed() {
+		return nil, ErrBrokerShutdown
+	}
+
 	p := &MockProducer{
 		exchange: exchange,
 		broker:   b,
+		config:   config,
 	}
+	p.publishChain = wrapPublish(p.deliver, nil, config)
 
 	return p, nil
 }
+
+// Subscribe subscribes to the broker's events, use Emit to simulate them (mock)
+func (b *MockBroker) Subscribe(types ...EventType) *Subscription {
+	return b.events.subscribe(types...)
+}
+
+// Emit emits an event to the broker's subscribers, to simulate connection and channel state changes in tests (mock)
+func (b *MockBroker) Emit(event Event) {
+	b.events.emit(event)
+}
+
+// Health reports the broker as healthy until it is shut down (mock)
+func (b *MockBroker) Health() HealthReport {
+	return HealthReport{
+		Healthy:   !b.isClosed(),
+		Consumers: make([]ConsumerHealth, 0),
+		Producers: make([]ProducerHealth, 0),
+	}
+}
+
+// Shutdown stops accepting new consumers, producers and messages, ends consumption and waits for the running message handlers (mock)
+func (b *MockBroker) Shutdown(ctx context.Context) error {
+	b.shutdown.Do(func() {
+		// Wake up blocked deliveries, so they release the read lock
+		close(b.done)
+
+		b.mu.Lock()
+		b.closed = true
+		for _, messages := range b.Messages {
+			close(messages)
+		}
+		b.mu.Unlock()
+	})
+	return waitContext(ctx, b.handlers.Wait)
+}
+
+// isClosed returns whether the broker has been shut down (mock)
+func (b *MockBroker) isClosed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.closed
+}
@@ -1,7 +1,9 @@
 package alice
 
 import (
-	"github.com/rs/zerolog/log"
+	"context"
+	"errors"
+
 	"github.com/streadway/amqp"
 )
 
@@ -9,24 +11,45 @@ import (
 type MockConsumer struct {
 	queue            *Queue
 	broker           *MockBroker
+	config           *ConsumerConfig
 	ReceivedMessages []amqp.Delivery
 }
 
 // ConsumeMessages consumes messages sent to the consumer
 func (c *MockConsumer) ConsumeMessages(args amqp.Table, autoAck bool, messageHandler func(amqp.Delivery)) {
-	for msg := range c.broker.Messages[c.queue] {
+	c.Consume(args, legacyHandler(autoAck, messageHandler))
+}
+
+// Consume consumes messages sent to the consumer, mock deliveries cannot be acknowledged so the handler outcome is ignored
+// The handler is wrapped with the consumer's middleware
+func (c *MockConsumer) Consume(args amqp.Table, handler Handler) {
+	handler = wrapHandler(handler, nil, c.config)
+
+	c.broker.mu.RLock()
+	messages := c.broker.Messages[c.queue]
+	c.broker.mu.RUnlock()
+
+	// The broker closes the messages on shutdown
+	for msg := range messages {
 		c.ReceivedMessages = append(c.ReceivedMessages, msg)
 
+		// Registering the handler under the lock keeps it from racing the wait in Shutdown
+		c.broker.mu.RLock()
+		if c.broker.closed {
+			c.broker.mu.RUnlock()
+			return
+		}
+		c.broker.handlers.Add(1)
+		c.broker.mu.RUnlock()
+
 		go func(msg amqp.Delivery) {
-			// Intercept any errors propagating up the stack
-			defer func() {
-				if err := recover(); err != nil {
-					log.Err(err.(error)).Msg("error occurred")
-				}
-			}()
-
-			// Call the message handler
-			messageHandler(msg)
+			defer c.broker.handlers.Done()
+
+			// Call the message handler, panics are turned into errors by the Recover middleware
+			var panicErr *PanicError
+			if err := handler(context.Background(), msg); errors.As(err, &panicErr) {
+				c.broker.log.Log(ErrorLevel, "error occurred", "err", panicErr.Value)
+			}
 		}(msg)
 	}
 }
@@ -0,0 +1,11 @@
+module github.com/thijsheijden/alice/otel
+
+go 1.16
+
+require (
+	github.com/thijsheijden/alice v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+)
+
+replace github.com/thijsheijden/alice => ../
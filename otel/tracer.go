@@ -0,0 +1,75 @@
+// Package otel implements an alice.Tracer on top of OpenTelemetry
+package otel
+
+import (
+	"context"
+
+	"github.com/thijsheijden/alice"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the OpenTelemetry tracer alice's spans are started with
+const instrumentationName = "github.com/thijsheijden/alice"
+
+// tracer implements alice.Tracer with an OpenTelemetry tracer and propagator
+type tracer struct {
+	tracer     trace.Tracer                  // Starts the spans
+	propagator propagation.TextMapPropagator // Injects and extracts the trace context
+}
+
+/*
+CreateTracer creates an alice.Tracer starting OpenTelemetry spans
+	provider: trace.TracerProvider, provides the tracer the spans are started with, e.g. otel.GetTracerProvider()
+	propagator: propagation.TextMapPropagator, propagates the trace context through the message headers, nil for W3C trace context
+	Returns alice.Tracer
+*/
+func CreateTracer(provider trace.TracerProvider, propagator propagation.TextMapPropagator) alice.Tracer {
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+
+	return &tracer{
+		tracer:     provider.Tracer(instrumentationName),
+		propagator: propagator,
+	}
+}
+
+// Start starts an OpenTelemetry span as a child of the span carried by ctx
+func (t *tracer) Start(ctx context.Context, name string, kind alice.SpanKind, attributes map[string]string) (context.Context, alice.Span) {
+	attrs := make([]attribute.KeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKind(kind)), trace.WithAttributes(attrs...))
+	return ctx, span{span: s}
+}
+
+// Inject writes the trace context carried by ctx into the message headers
+func (t *tracer) Inject(ctx context.Context, carrier alice.HeaderCarrier) {
+	t.propagator.Inject(ctx, carrier)
+}
+
+// Extract reads the trace context from the message headers
+func (t *tracer) Extract(ctx context.Context, carrier alice.HeaderCarrier) context.Context {
+	return t.propagator.Extract(ctx, carrier)
+}
+
+// span implements alice.Span with an OpenTelemetry span
+type span struct {
+	span trace.Span // The OpenTelemetry span
+}
+
+// RecordError records the error on the span and sets its status to error
+func (s span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span
+func (s span) End() {
+	s.span.End()
+}
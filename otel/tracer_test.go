@@ -0,0 +1,35 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thijsheijden/alice"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracerPropagatesTraceContext(t *testing.T) {
+	tracer := CreateTracer(trace.NewNoopTracerProvider(), nil)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	parent := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	ctx, span := tracer.Start(parent, "orders publish", alice.SpanKindProducer, map[string]string{"messaging.system": "rabbitmq"})
+	defer span.End()
+
+	headers := alice.HeaderCarrier{}
+	tracer.Inject(ctx, headers)
+	if got := headers.Get("traceparent"); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent = %q", got)
+	}
+
+	extracted := trace.SpanContextFromContext(tracer.Extract(context.Background(), headers))
+	if extracted.TraceID() != traceID || !extracted.IsRemote() {
+		t.Errorf("extracted span context = %+v, want the remote parent", extracted)
+	}
+}
@@ -0,0 +1,120 @@
+package alice
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// createOutageTestProducer creates a producer without a channel, as if its channel was lost, using the given outage policy
+func createOutageTestProducer(t *testing.T, policy OutagePolicy) *RabbitProducer {
+	config := CreateProducerConfig()
+	config.SetOutagePolicy(policy)
+	config.SetOutageBuffer(2)
+	return newTestProducer(t, config)
+}
+
+func TestFailDuringOutage(t *testing.T) {
+	p := createOutageTestProducer(t, FailDuringOutage)
+
+	if err := p.Publish(context.Background(), []byte("lost"), "key", nil); err != ErrProducerUnavailable {
+		t.Errorf("err = %v, want %v", err, ErrProducerUnavailable)
+	}
+	if spooled, _ := p.Spooled(); len(spooled) != 0 {
+		t.Errorf("spooled %d messages, want 0", len(spooled))
+	}
+}
+
+func TestBlockDuringOutage(t *testing.T) {
+	p := createOutageTestProducer(t, BlockDuringOutage)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := p.Publish(ctx, []byte("late"), "key", nil); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A blocked publish goes through once the producer has recovered
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Publish(context.Background(), []byte("waited"), "key", nil)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	published := connectFakeBroker(t, p)
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("publish was not woken up by the recovery")
+	}
+	if message := <-published; message.body != "waited" {
+		t.Errorf("published %q, want %q", message.body, "waited")
+	}
+
+	// Shutting down fails blocked publishes
+	p.publishMutex.Lock()
+	p.available = false
+	p.publishMutex.Unlock()
+	go func() {
+		errs <- p.Publish(context.Background(), []byte("shut down"), "key", nil)
+	}()
+	time.Sleep(time.Millisecond * 20)
+	p.Shutdown()
+
+	if err := <-errs; err != ErrChannelClosed {
+		t.Errorf("err = %v, want %v", err, ErrChannelClosed)
+	}
+}
+
+func TestBufferDuringOutage(t *testing.T) {
+	p := createOutageTestProducer(t, BufferDuringOutage)
+
+	for _, body := range []string{"first", "second"} {
+		if err := p.Publish(context.Background(), []byte(body), "key", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Publish(context.Background(), []byte("third"), "key", nil); err != ErrOutageBufferFull {
+		t.Errorf("err = %v, want %v", err, ErrOutageBufferFull)
+	}
+
+	if h := p.health(); h.Buffered != 2 {
+		t.Errorf("health reports %d buffered messages, want 2", h.Buffered)
+	}
+
+	// The buffer is replayed in order once the producer has recovered, before any new message
+	published := connectFakeBroker(t, p)
+	if err := p.Publish(context.Background(), []byte("after"), "key", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		select {
+		case message := <-published:
+			bodies = append(bodies, message.body)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("published %v, want 3 messages", bodies)
+		}
+	}
+	if want := []string{"first", "second", "after"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("published %v, want %v", bodies, want)
+	}
+	if spooled, _ := p.Spooled(); len(spooled) != 0 {
+		t.Errorf("spooled %d messages after the replay, want 0", len(spooled))
+	}
+}
+
+func TestShutdownDuringOutage(t *testing.T) {
+	// A producer which never opened a channel still shuts down cleanly
+	if err := createOutageTestProducer(t, FailDuringOutage).Shutdown(); err != nil {
+		t.Errorf("shutdown returned %v", err)
+	}
+	if err := createOutageTestProducer(t, FailDuringOutage).drain(context.Background()); err != nil {
+		t.Errorf("drain returned %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/thijsheijden/alice/outbox
+
+go 1.16
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/streadway/amqp v1.0.0
+	github.com/thijsheijden/alice v0.0.0-00010101000000-000000000000
+)
+
+replace github.com/thijsheijden/alice => ../
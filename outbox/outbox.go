@@ -0,0 +1,270 @@
+// Package outbox implements the transactional outbox pattern on database/sql
+// Messages are stored in the same transaction as the domain rows they belong to, and a Relay publishes them through an alice.Producer afterwards
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func init() {
+	// The types header values can have besides the basic types gob knows about
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(amqp.Decimal{})
+}
+
+// ErrInvalidTable is returned when creating an outbox with a table name which is not a plain SQL identifier
+var ErrInvalidTable = errors.New("outbox table name must be a plain SQL identifier")
+
+// tableName matches plain, optionally schema qualified, SQL identifiers
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// A Dialect adapts the outbox queries to a database
+type Dialect struct {
+	Placeholder func(n int) string // Returns the placeholder of the n-th query argument, starting at 1
+	IDColumn    string             // Type of the auto-incrementing primary key column
+	BlobType    string             // Column type of the message bodies and headers
+	TimeType    string             // Column type of the timestamps
+}
+
+var (
+	// SQLite is the dialect of SQLite
+	SQLite = Dialect{
+		Placeholder: questionMark,
+		IDColumn:    "INTEGER PRIMARY KEY AUTOINCREMENT",
+		BlobType:    "BLOB",
+		TimeType:    "TIMESTAMP",
+	}
+
+	// MySQL is the dialect of MySQL and MariaDB
+	MySQL = Dialect{
+		Placeholder: questionMark,
+		IDColumn:    "BIGINT AUTO_INCREMENT PRIMARY KEY",
+		BlobType:    "LONGBLOB",
+		TimeType:    "DATETIME(6)",
+	}
+
+	// Postgres is the dialect of PostgreSQL
+	Postgres = Dialect{
+		Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		IDColumn:    "BIGSERIAL PRIMARY KEY",
+		BlobType:    "BYTEA",
+		TimeType:    "TIMESTAMPTZ",
+	}
+)
+
+// questionMark returns the placeholder of drivers using question marks
+func questionMark(n int) string {
+	return "?"
+}
+
+// A Message is a message to publish once the transaction storing it has been committed
+type Message struct {
+	RoutingKey string     // The routing key to publish the message with
+	Headers    amqp.Table // The message headers, stored with gob so they are published with the same types
+	Body       []byte     // The message body
+}
+
+// An Outbox stores messages in a database table until a Relay has published them
+type Outbox struct {
+	db      *sql.DB // The database the table is in
+	table   string  // Name of the outbox table
+	dialect Dialect // The dialect of the database
+}
+
+// record is a stored message
+type record struct {
+	id       int64    // The primary key of the row
+	message  *Message // The stored message
+	attempts int      // Number of failed attempts to publish the message
+}
+
+/*
+CreateOutbox creates an outbox storing messages in the given table, see CreateTable to create it
+	db: *sql.DB, the database the table is in
+	table: string, name of the outbox table, optionally qualified with a schema
+	dialect: Dialect, the dialect of the database, e.g. SQLite, MySQL or Postgres
+	Returns the Outbox and ErrInvalidTable if the table name is not a plain SQL identifier
+*/
+func CreateOutbox(db *sql.DB, table string, dialect Dialect) (*Outbox, error) {
+	if !tableName.MatchString(table) {
+		return nil, ErrInvalidTable
+	}
+
+	return &Outbox{
+		db:      db,
+		table:   table,
+		dialect: dialect,
+	}, nil
+}
+
+// CreateTable creates the outbox table if it does not exist yet
+func (o *Outbox) CreateTable(ctx context.Context) error {
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id %s,
+	routing_key VARCHAR(255) NOT NULL,
+	headers %s NOT NULL,
+	body %s NOT NULL,
+	created_at %s NOT NULL,
+	sent_at %s NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NULL
+)`, o.table, o.dialect.IDColumn, o.dialect.BlobType, o.dialect.BlobType, o.dialect.TimeType, o.dialect.TimeType))
+	return err
+}
+
+/*
+Store stores messages in the outbox as part of the caller's transaction
+The messages are published by a Relay once the transaction has been committed, and never if it is rolled back
+	ctx: context.Context, bounds the inserts
+	tx: *sql.Tx, the transaction to store the messages in
+	messages: ...*Message, the messages to store
+	Returns a possible error, e.g. for headers of a type AMQP does not support, after which the transaction should be rolled back
+*/
+func (o *Outbox) Store(ctx context.Context, tx *sql.Tx, messages ...*Message) error {
+	query := fmt.Sprintf("INSERT INTO %s (routing_key, headers, body, created_at) VALUES (%s, %s, %s, %s)",
+		o.table, o.placeholder(1), o.placeholder(2), o.placeholder(3), o.placeholder(4))
+
+	now := time.Now().UTC()
+	for _, message := range messages {
+		headers, err := encodeHeaders(message.Headers)
+		if err != nil {
+			return err
+		}
+
+		body := message.Body
+		if body == nil {
+			body = []byte{}
+		}
+
+		_, err = tx.ExecContext(ctx, query, message.RoutingKey, headers, body, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns the number of messages which have not been published yet
+func (o *Outbox) Pending(ctx context.Context) (int64, error) {
+	var pending int64
+	err := o.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE sent_at IS NULL", o.table)).Scan(&pending)
+	return pending, err
+}
+
+/*
+DeleteSent deletes the published messages which were published before the given time
+	ctx: context.Context, bounds the delete
+	before: time.Time, messages published before this time are deleted
+	Returns the number of deleted messages and a possible error
+*/
+func (o *Outbox) DeleteSent(ctx context.Context, before time.Time) (int64, error) {
+	result, err := o.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE sent_at IS NOT NULL AND sent_at < %s", o.table, o.placeholder(1)), before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// pending reads up to limit unpublished messages in the order they were stored
+// Messages which failed maxAttempts times are skipped, unless maxAttempts is 0
+func (o *Outbox) pending(ctx context.Context, limit int, maxAttempts int) ([]*record, error) {
+	query := fmt.Sprintf("SELECT id, routing_key, headers, body, attempts FROM %s WHERE sent_at IS NULL", o.table)
+	args := []interface{}{}
+	if maxAttempts > 0 {
+		query += " AND attempts < " + o.placeholder(1)
+		args = append(args, maxAttempts)
+	}
+	query += fmt.Sprintf(" ORDER BY id LIMIT %d", limit)
+
+	rows, err := o.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*record
+	for rows.Next() {
+		r := &record{message: &Message{}}
+		var headers []byte
+		err = rows.Scan(&r.id, &r.message.RoutingKey, &headers, &r.message.Body, &r.attempts)
+		if err != nil {
+			return nil, err
+		}
+
+		r.message.Headers, err = decodeHeaders(headers)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// markSent marks messages as published
+func (o *Outbox) markSent(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := []interface{}{time.Now().UTC()}
+	placeholders := make([]string, 0, len(ids))
+	for i, id := range ids {
+		placeholders = append(placeholders, o.placeholder(i+2))
+		args = append(args, id)
+	}
+
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET sent_at = %s WHERE id IN (%s)",
+		o.table, o.placeholder(1), strings.Join(placeholders, ", ")), args...)
+	return err
+}
+
+// markFailed records a failed attempt to publish a message
+func (o *Outbox) markFailed(ctx context.Context, id int64, cause error) error {
+	_, err := o.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET attempts = attempts + 1, last_error = %s WHERE id = %s",
+		o.table, o.placeholder(1), o.placeholder(2)), cause.Error(), id)
+	return err
+}
+
+// encodeHeaders encodes message headers with gob, rejecting types AMQP does not support
+func encodeHeaders(headers amqp.Table) ([]byte, error) {
+	if len(headers) == 0 {
+		return []byte{}, nil
+	}
+
+	err := headers.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(headers)
+	return buf.Bytes(), err
+}
+
+// decodeHeaders decodes message headers encoded by encodeHeaders
+func decodeHeaders(encoded []byte) (amqp.Table, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	var headers amqp.Table
+	err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&headers)
+	return headers, err
+}
+
+// placeholder returns the placeholder of the n-th query argument
+func (o *Outbox) placeholder(n int) string {
+	return o.dialect.Placeholder(n)
+}
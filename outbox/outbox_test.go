@@ -0,0 +1,281 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/streadway/amqp"
+	"github.com/thijsheijden/alice"
+)
+
+// createTestOutbox creates an outbox in a fresh SQLite database
+func createTestOutbox(t *testing.T) *Outbox {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	outbox, err := CreateOutbox(db, "outbox", SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.CreateTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return outbox
+}
+
+// store stores messages in a transaction, committing it or rolling it back
+func store(t *testing.T, outbox *Outbox, commit bool, messages ...*Message) {
+	ctx := context.Background()
+	tx, err := outbox.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Store(ctx, tx, messages...); err != nil {
+		t.Fatal(err)
+	}
+
+	if commit {
+		err = tx.Commit()
+	} else {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateOutboxInvalidTable(t *testing.T) {
+	_, err := CreateOutbox(nil, "outbox; DROP TABLE users", SQLite)
+	if err != ErrInvalidTable {
+		t.Errorf("err = %v, want %v", err, ErrInvalidTable)
+	}
+}
+
+func TestStoreHeaders(t *testing.T) {
+	ctx := context.Background()
+	outbox := createTestOutbox(t)
+
+	// Headers keep their types
+	headers := amqp.Table{
+		"count":    int32(3),
+		"total":    int64(1 << 40),
+		"price":    amqp.Decimal{Scale: 2, Value: 1999},
+		"placedAt": time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		"raw":      []byte{1, 2, 3},
+		"tags":     []interface{}{"a", int16(2)},
+		"customer": amqp.Table{"id": int64(42)},
+	}
+	store(t, outbox, true, &Message{RoutingKey: "key", Headers: headers, Body: []byte("typed")})
+
+	records, err := outbox.pending(ctx, 10, 0)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("pending = %d, %v, want 1", len(records), err)
+	}
+	if got := records[0].message.Headers; !reflect.DeepEqual(got, headers) {
+		t.Errorf("headers = %#v, want %#v", got, headers)
+	}
+
+	// Headers AMQP cannot carry are rejected when storing the message
+	tx, err := outbox.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err = outbox.Store(ctx, tx, &Message{RoutingKey: "key", Headers: amqp.Table{"count": uint32(3)}}); err == nil {
+		t.Error("expected storing a message with an unsupported header type to fail")
+	}
+}
+
+func TestRelayBatchSize(t *testing.T) {
+	relay := CreateRelay(nil, nil)
+
+	relay.SetBatchSize(0)
+	if relay.batchSize != 1 {
+		t.Errorf("batch size = %d, want 1", relay.batchSize)
+	}
+	relay.SetBatchSize(-1)
+	if relay.batchSize != 1 {
+		t.Errorf("batch size = %d, want 1", relay.batchSize)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+	outbox := createTestOutbox(t)
+
+	store(t, outbox, true,
+		&Message{RoutingKey: "key", Headers: amqp.Table{"order": "1"}, Body: []byte("first")},
+		&Message{RoutingKey: "key", Body: []byte("second")},
+	)
+	store(t, outbox, false, &Message{RoutingKey: "key", Body: []byte("rolled back")})
+
+	if pending, err := outbox.Pending(ctx); err != nil || pending != 2 {
+		t.Fatalf("pending = %d, %v, want 2", pending, err)
+	}
+
+	broker := alice.CreateMockBroker()
+	exchange, _ := alice.CreateExchange("test-exchange", alice.Direct, false, true, false, false, nil)
+	queue := alice.CreateQueue(exchange, "test-queue", false, false, true, false, nil)
+
+	c, _ := broker.CreateConsumer(queue, "key", "")
+	p, _ := broker.CreateProducer(exchange)
+
+	received := make(chan amqp.Delivery, 3)
+	go c.Consume(nil, func(ctx context.Context, delivery amqp.Delivery) error {
+		received <- delivery
+		return nil
+	})
+
+	relay := CreateRelay(outbox, p)
+	sent, err := relay.RelayBatch(ctx)
+	if err != nil || sent != 2 {
+		t.Fatalf("sent = %d, %v, want 2", sent, err)
+	}
+
+	bodies := map[string]amqp.Delivery{}
+	for i := 0; i < 2; i++ {
+		delivery := <-received
+		bodies[string(delivery.Body)] = delivery
+	}
+	if _, ok := bodies["second"]; !ok {
+		t.Errorf("received %v, want first and second", bodies)
+	}
+	if first, ok := bodies["first"]; !ok || first.Headers["order"] != "1" {
+		t.Errorf("first message = %+v, want header order=1", first)
+	}
+
+	// Sent messages are not published again
+	if sent, err = relay.RelayBatch(ctx); err != nil || sent != 0 {
+		t.Errorf("second batch sent = %d, %v, want 0", sent, err)
+	}
+	if pending, _ := outbox.Pending(ctx); pending != 0 {
+		t.Errorf("pending = %d, want 0", pending)
+	}
+
+	deleted, err := outbox.DeleteSent(ctx, time.Now().Add(time.Minute))
+	if err != nil || deleted != 2 {
+		t.Errorf("deleted = %d, %v, want 2", deleted, err)
+	}
+}
+
+func TestRelayFailure(t *testing.T) {
+	ctx := context.Background()
+	outbox := createTestOutbox(t)
+
+	store(t, outbox, true,
+		&Message{RoutingKey: "key", Body: []byte("first")},
+		&Message{RoutingKey: "unbound", Body: []byte("lost")},
+		&Message{RoutingKey: "key", Body: []byte("last")},
+	)
+
+	broker := alice.CreateMockBroker()
+	exchange, _ := alice.CreateExchange("test-exchange", alice.Direct, false, true, false, false, nil)
+	queue := alice.CreateQueue(exchange, "test-queue", false, false, true, false, nil)
+
+	c, _ := broker.CreateConsumer(queue, "key", "")
+	config := alice.CreateProducerConfig()
+	config.SetConfirmMode(true)
+	p, _ := broker.CreateProducerWithConfig(exchange, config)
+
+	go c.Consume(nil, func(ctx context.Context, delivery amqp.Delivery) error {
+		return nil
+	})
+
+	options := alice.CreateDefaultPublishOptions()
+	options.SetMandatory(true)
+
+	relay := CreateRelay(outbox, p)
+	relay.SetPublishOptions(options)
+	relay.SetMaxAttempts(2)
+
+	// The batch stops at the unroutable message, the message after it is not marked as sent
+	sent, err := relay.RelayBatch(ctx)
+	var batchErr *alice.BatchError
+	if sent != 1 || !errors.As(err, &batchErr) || !errors.Is(batchErr.Failures[0].Err, alice.ErrUnroutable) {
+		t.Fatalf("sent = %d, %v, want 1 and %v", sent, err, alice.ErrUnroutable)
+	}
+	if pending, _ := outbox.Pending(ctx); pending != 2 {
+		t.Errorf("pending = %d, want 2", pending)
+	}
+
+	var attempts int
+	var lastError string
+	err = outbox.db.QueryRow("SELECT attempts, last_error FROM outbox WHERE body = ?", []byte("lost")).Scan(&attempts, &lastError)
+	if err != nil || attempts != 1 || lastError == "" {
+		t.Errorf("attempts = %d, last error = %q, %v, want 1 and an error", attempts, lastError, err)
+	}
+
+	// The failed message is retried until it reaches the maximum number of attempts, then the relay moves past it
+	if sent, err = relay.RelayBatch(ctx); sent != 0 || err == nil {
+		t.Errorf("retry sent = %d, %v, want 0 and an error", sent, err)
+	}
+	if sent, err = relay.RelayBatch(ctx); sent != 1 || err != nil {
+		t.Errorf("batch after skipping sent = %d, %v, want 1 and no error", sent, err)
+	}
+	if pending, _ := outbox.Pending(ctx); pending != 1 {
+		t.Errorf("pending = %d, want 1", pending)
+	}
+}
+
+func TestRelayRun(t *testing.T) {
+	outbox := createTestOutbox(t)
+
+	broker := alice.CreateMockBroker()
+	exchange, _ := alice.CreateExchange("test-exchange", alice.Direct, false, true, false, false, nil)
+	queue := alice.CreateQueue(exchange, "test-queue", false, false, true, false, nil)
+
+	// Mock consumers handle every delivery in a new goroutine, so record the order messages are published in instead
+	published := make(chan string, 3)
+	config := alice.CreateProducerConfig()
+	config.AddMiddleware(func(next alice.PublishFunc) alice.PublishFunc {
+		return func(ctx context.Context, message *alice.Message) (*alice.Confirmation, error) {
+			published <- string(message.Body)
+			return next(ctx, message)
+		}
+	})
+
+	c, _ := broker.CreateConsumer(queue, "key", "")
+	p, _ := broker.CreateProducerWithConfig(exchange, config)
+	go c.Consume(nil, func(ctx context.Context, delivery amqp.Delivery) error {
+		return nil
+	})
+
+	relay := CreateRelay(outbox, p)
+	relay.SetPollInterval(time.Millisecond * 10)
+	relay.SetBatchSize(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- relay.Run(ctx) }()
+
+	// Messages stored while the relay is running are published in order
+	store(t, outbox, true,
+		&Message{RoutingKey: "key", Body: []byte("first")},
+		&Message{RoutingKey: "key", Body: []byte("second")},
+		&Message{RoutingKey: "key", Body: []byte("third")},
+	)
+	for _, want := range []string{"first", "second", "third"} {
+		select {
+		case body := <-published:
+			if body != want {
+				t.Errorf("published %q, want %q", body, want)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,152 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/thijsheijden/alice"
+)
+
+// A Relay publishes the messages stored in an outbox and marks them as sent
+// Messages are published at least once: a message is published again when marking it as sent fails.
+// Messages are marked as sent in the order they were stored, the relay does not get past a failed message until it is sent or skipped.
+// Run a single relay per outbox table, concurrent relays publish the same messages.
+type Relay struct {
+	outbox      *Outbox               // The outbox to relay messages from
+	producer    alice.Producer        // The producer to publish the messages with
+	options     *alice.PublishOptions // The options to publish with, nil for the producer defaults
+	interval    time.Duration         // How long to wait before polling again when the outbox is empty
+	batchSize   int                   // Maximum number of messages published at once
+	maxAttempts int                   // Number of failed attempts after which a message is skipped, 0 means unlimited
+	log         alice.Logger          // Receives the errors of Run
+}
+
+/*
+CreateRelay creates a relay publishing the messages of an outbox with the given producer
+Create the producer in confirm mode, so messages are only marked as sent once the broker has confirmed them
+	outbox: *Outbox, the outbox to relay messages from
+	producer: alice.Producer, the producer to publish the messages with
+	Returns *Relay, polling every second and publishing up to 100 messages at once
+*/
+func CreateRelay(outbox *Outbox, producer alice.Producer) *Relay {
+	return &Relay{
+		outbox:    outbox,
+		producer:  producer,
+		interval:  time.Second,
+		batchSize: 100,
+		log:       alice.CreateDefaultLogger(),
+	}
+}
+
+// SetPollInterval sets how long the relay waits before polling again when the outbox is empty or publishing failed
+func (r *Relay) SetPollInterval(interval time.Duration) {
+	r.interval = interval
+}
+
+// SetBatchSize sets the maximum number of messages published at once, sizes below 1 are raised to 1
+func (r *Relay) SetBatchSize(batchSize int) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	r.batchSize = batchSize
+}
+
+// SetPublishOptions sets the options messages are published with, nil uses the producer defaults
+func (r *Relay) SetPublishOptions(options *alice.PublishOptions) {
+	r.options = options
+}
+
+// SetMaxAttempts sets the number of failed attempts after which a message is no longer published, 0 means unlimited
+// Skipped messages stay in the outbox, with the error of their last attempt
+func (r *Relay) SetMaxAttempts(maxAttempts int) {
+	r.maxAttempts = maxAttempts
+}
+
+// SetLogger sets the logger receiving the errors of Run, by default alice.CreateDefaultLogger is used
+func (r *Relay) SetLogger(logger alice.Logger) {
+	r.log = logger
+}
+
+/*
+Run relays messages until the context is done
+A full batch is followed by the next one right away, otherwise the relay waits for the poll interval
+	ctx: context.Context, stops the relay once done
+	Returns the context's error
+*/
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		sent, err := r.RelayBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.log.Log(alice.ErrorLevel, "failed to relay outbox messages", "type", "outbox", "table", r.outbox.table, "err", err)
+		}
+
+		if err != nil || sent < r.batchSize {
+			select {
+			case <-time.After(r.interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+RelayBatch publishes the next batch of messages in the order they were stored and marks the published ones as sent
+The batch stops at the first message which failed to publish: the messages before it are marked as sent, it is retried by the next batch.
+The later messages of the batch have been published already, so they are published again after the failed message and may be received twice.
+	ctx: context.Context, bounds publishing and updating the outbox
+	Returns the number of messages sent and a possible error, an *alice.BatchError if some messages failed to publish
+*/
+func (r *Relay) RelayBatch(ctx context.Context) (int, error) {
+	records, err := r.outbox.pending(ctx, r.batchSize, r.maxAttempts)
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+
+	messages := make([]*alice.Message, 0, len(records))
+	for _, record := range records {
+		messages = append(messages, &alice.Message{
+			Body:       record.message.Body,
+			RoutingKey: record.message.RoutingKey,
+			Headers:    record.message.Headers,
+			Options:    r.options,
+		})
+	}
+
+	publishErr := r.producer.PublishBatch(ctx, messages)
+
+	// Find out which messages failed
+	failed := make(map[int]error)
+	var batchErr *alice.BatchError
+	if errors.As(publishErr, &batchErr) {
+		for _, failure := range batchErr.Failures {
+			failed[failure.Index] = failure.Err
+		}
+	} else if publishErr != nil {
+		for i := range records {
+			failed[i] = publishErr
+		}
+	}
+
+	// Stop at the first failure, so no message is marked as sent before the messages stored ahead of it
+	sent := make([]int64, 0, len(records))
+	for i, record := range records {
+		if cause, ok := failed[i]; ok {
+			err = r.outbox.markFailed(ctx, record.id, cause)
+			if err != nil {
+				return 0, err
+			}
+			break
+		}
+		sent = append(sent, record.id)
+	}
+
+	err = r.outbox.markSent(ctx, sent)
+	if err != nil {
+		return 0, err
+	}
+	return len(sent), publishErr
+}
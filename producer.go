@@ -1,74 +1,190 @@
 package alice
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
 	"time"
 
-	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
 )
 
+var (
+	// ErrProducerUnavailable is returned when publishing while the producer is recovering its channel
+	ErrProducerUnavailable = errors.New("producer is recovering its channel")
+
+	// ErrOutageBufferFull is returned when a message cannot be spooled because the spool is full
+	ErrOutageBufferFull = errors.New("producer outage buffer is full")
+
+	// ErrFlowPaused is returned when publishing while the broker has paused the producer's channel, with FailDuringFlowControl
+	ErrFlowPaused = errors.New("broker paused publishing on the producer channel")
+
+	// ErrConnectionBlocked is returned when publishing while the broker has blocked the producer's connection, with FailDuringFlowControl
+	ErrConnectionBlocked = errors.New("broker blocked the producer connection")
+)
+
 // RabbitProducer models a RabbitMQ producer
 type RabbitProducer struct {
-	channel  *amqp.Channel // The channel this producer uses to communicate with the broker
-	exchange *Exchange     // The exchange this producer produces to
-	conn     *connection   // Pointer to broker connection
+	exchange     *Exchange       // The exchange this producer produces to
+	conn         *connection     // Pointer to broker connection
+	config       *ProducerConfig // The configuration of this producer
+	publishMutex sync.Mutex      // Guards the fields below and serializes publishes so delivery tags match the order of publishing
+	stateMutex   sync.Mutex      // Also held when writing available, closed, err and lastErr, so health probes can read them without waiting for a publish
+	channel      *amqp.Channel   // The channel this producer uses to communicate with the broker
+	confirms     *confirmTracker // Unconfirmed messages, nil if the producer is not in confirm mode
+	available    bool            // Whether the channel is open and ready for publishing
+	closed       bool            // Whether the producer has been shut down
+	err          error           // Terminal error once recovering the channel has been given up on
+	lastErr      error           // The last error the channel was closed with or failed to re-open with
+	recovered    chan struct{}   // Closed once the producer has recovered from an outage
+
+	spool    SpoolStore                      // Messages published during an outage, with a configured store also messages awaiting their confirmation
+	spooled  map[uint64]*spooledConfirmation // Confirmations handed to the publishers of spooled messages, by message ID
+	replayed bool                            // Whether the spooled messages have been replayed on the current channel
+	spooling sync.WaitGroup                  // Goroutines awaiting the confirmations of spooled messages
+
+	publishChain PublishFunc   // Publishes messages through the publish middleware
+	flowMutex    sync.Mutex    // Guards the two fields below, may be locked while holding the publish mutex
+	flowPaused   bool          // Whether the broker has paused the channel with channel.flow
+	flowResumed  chan struct{} // Closed once the broker resumes the channel, or the channel is replaced or shut down
+}
+
+// FlowState describes whether the broker allows a producer to publish
+type FlowState struct {
+	Paused  bool   // Whether the broker has paused the producer's channel with channel.flow
+	Blocked bool   // Whether the broker has blocked the producer's connection with connection.blocked
+	Reason  string // The reason the broker gave for blocking the connection
+}
+
+// Active returns whether the broker allows publishing
+func (s FlowState) Active() bool {
+	return !s.Paused && !s.Blocked
+}
+
+// spooledConfirmation is the confirmation handed to the publisher of a spooled message
+type spooledConfirmation struct {
+	confirmation *Confirmation // Resolved once the broker confirmed the message or it has been given up on
+	pending      *Confirmation // Confirmation of the message on the current channel, nil if it is not in flight
+}
+
+// newProducer creates a producer without a channel
+func newProducer(c *connection, exchange *Exchange, config *ProducerConfig) *RabbitProducer {
+	p := &RabbitProducer{
+		exchange:    exchange,
+		conn:        c,
+		config:      config,
+		recovered:   make(chan struct{}),
+		flowResumed: make(chan struct{}),
+		spool:       config.spool,
+		spooled:     make(map[uint64]*spooledConfirmation),
+	}
+	if p.spool == nil {
+		p.spool = createMemorySpool(config.outageBuffer)
+	}
+	p.publishChain = wrapPublish(p.publishMessage, c.config.publishMiddleware, config)
+	return p
 }
 
 // CreateProducer creates and returns a producer attached to the given exchange.
 // The errorHandler can be the DefaultProducerErrorHandler or a custom handler.
-func (c *connection) createProducer(exchange *Exchange) (*RabbitProducer, error) {
-
-	var err error
+func (c *connection) createProducer(exchange *Exchange, config *ProducerConfig) (*RabbitProducer, error) {
 
 	// Create producer object
-	p := &RabbitProducer{
-		channel:  nil,
-		exchange: exchange,
-		conn:     c,
+	p := newProducer(c, exchange, config)
+
+	// Open the channel, declare the exchange and listen for broker notifications
+	err := p.setup()
+	if err != nil {
+		return nil, err
 	}
 
+	c.log.Log(InfoLevel, "created producer", "exchange", exchange.name)
+
+	return p, nil
+}
+
+// setup opens a channel, declares the exchange and registers all broker listeners
+// Once done the channel becomes the producer's channel and any buffered messages are published
+func (p *RabbitProducer) setup() error {
 	// Open channel to broker
-	err = p.openChannel(c)
+	channel, err := p.openChannel()
 	if err != nil {
 		// Throw error that channel could not be opened
-		return nil, err
+		return err
 	}
 
 	// Declare the exchange
-	err = p.declareExchange(exchange)
+	err = p.declareExchange(channel, p.exchange)
 	if err != nil {
 		// Throw error that the exchange could not be declared
-		return nil, err
+		channel.Close()
+		return err
 	}
 
-	// Listen for channel or connection close message
-	p.listenForClose()
+	// Put the channel into confirm mode if requested
+	var confirms *confirmTracker
+	if p.config.confirmMode {
+		confirms, err = p.enableConfirms(channel)
+		if err != nil {
+			// Throw error that the channel could not be put into confirm mode
+			channel.Close()
+			return err
+		}
+	}
 
 	// Listen for overflow messages from broker
-	p.listenForFlow()
+	p.listenForFlow(channel)
 
-	// Listen for returned messages from the broker
-	p.listenForReturnedMessages()
+	// Listen for returned messages and publisher confirms from the broker
+	p.listenForReturnedMessages(channel, confirms)
 
-	log.Info().Str("exchange", exchange.name).Msg("created producer")
+	p.publishMutex.Lock()
+	if p.closed {
+		p.publishMutex.Unlock()
+		return channel.Close()
+	}
 
-	return p, nil
+	previous := p.channel
+	p.channel = channel
+	p.confirms = confirms
+	p.stateMutex.Lock()
+	p.available = true
+	p.err = nil
+	p.stateMutex.Unlock()
+	p.resumeFlow()
+	p.replaySpool()
+
+	// Wake up publishers blocked on the outage
+	close(p.recovered)
+	p.recovered = make(chan struct{})
+	p.publishMutex.Unlock()
+
+	// Listen for channel or connection close message
+	p.listenForClose(channel)
+
+	// Close the channel this one replaces, its close listener ignores it as it is no longer in use
+	if previous != nil {
+		previous.Close()
+	}
+
+	return nil
 }
 
 // Open channel to broker
-func (p *RabbitProducer) openChannel(c *connection) error {
-	var err error
-	log.Info().Str("type", "producer").Str("exchange", p.exchange.name).Msg("attempting to open channel")
-	p.channel, err = c.conn.Channel()
+func (p *RabbitProducer) openChannel() (*amqp.Channel, error) {
+	p.conn.log.Log(InfoLevel, "attempting to open channel", "type", "producer", "exchange", p.exchange.name)
+	channel, err := p.conn.channel()
 	if err != nil {
-		log.Error().AnErr("err", err).Str("type", "producer").Str("exchange", p.exchange.name).Msg("failed to open channel")
+		p.conn.log.Log(ErrorLevel, "failed to open channel", "err", err, "type", "producer", "exchange", p.exchange.name)
 	}
-	return err
+	return channel, err
 }
 
 // Declare exchange this producer will produce to
-func (p *RabbitProducer) declareExchange(exchange *Exchange) error {
-	err := p.channel.ExchangeDeclare(
+func (p *RabbitProducer) declareExchange(channel *amqp.Channel, exchange *Exchange) error {
+	err := channel.ExchangeDeclare(
 		exchange.name,
 		exchange.exchangeType.String(),
 		exchange.durable,
@@ -80,69 +196,720 @@ func (p *RabbitProducer) declareExchange(exchange *Exchange) error {
 	return err
 }
 
-// Subscribe to channel close events and make sure to respond to them
-func (p *RabbitProducer) listenForClose() {
-	closeChan := p.channel.NotifyClose(make(chan *amqp.Error))
+// Put the channel into confirm mode and start tracking broker acknowledgements
+func (p *RabbitProducer) enableConfirms(channel *amqp.Channel) (*confirmTracker, error) {
+	err := channel.Confirm(false)
+	if err != nil {
+		p.conn.log.Log(ErrorLevel, "failed to put channel into confirm mode", "err", err, "type", "producer", "exchange", p.exchange.name)
+		return nil, err
+	}
+
+	confirms := newConfirmTracker(func(c *Confirmation) {
+		p.conn.metrics.PublishConfirmed(p.exchange.name, c.routingKey, c.err == nil, time.Since(c.publishedAt))
+	})
+
+	return confirms, nil
+}
+
+// Subscribe to channel close events and recover the channel once the connection allows it
+func (p *RabbitProducer) listenForClose(channel *amqp.Channel) {
+	closeChan := channel.NotifyClose(make(chan *amqp.Error, 1))
 	go func() {
 		closeErr := <-closeChan
-		log.Error().Str("type", "producer").AnErr("err", closeErr).Str("exchange", p.exchange.name).Msg("connection was closed")
+
+		p.publishMutex.Lock()
+		// Ignore shutdowns and channels which have been replaced
+		if p.closed || p.channel != channel {
+			p.publishMutex.Unlock()
+			return
+		}
+		p.stateMutex.Lock()
+		p.available = false
+		if closeErr != nil {
+			p.lastErr = closeErr
+		}
+		p.stateMutex.Unlock()
+		p.replayed = false
+		p.publishMutex.Unlock()
+
+		p.conn.log.Log(ErrorLevel, "channel was closed", "type", "producer", "err", amqpError(closeErr), "exchange", p.exchange.name)
+		p.conn.events.emit(Event{Type: ChannelClosed, ConnType: "producer", Node: p.conn.currentNode(), Exchange: p.exchange.name, Err: amqpError(closeErr)})
+		p.recover()
 	}()
 }
 
+// recover re-opens the producer's channel once the connection is open, retrying according to the connection's backoff strategy
+// Once the connection or the backoff strategy gives up, the producer fails with the terminal error
+func (p *RabbitProducer) recover() {
+	var connErr error
+	err := retryWithBackoff(p.conn.ctx, p.conn.config.reconnectBackoff(), true, func(attempt int) error {
+		// Wait for the connection to be open again
+		connErr = p.conn.waitUntilOpen()
+		if connErr != nil {
+			return nil
+		}
+
+		err := p.setup()
+		if err != nil {
+			p.conn.log.Log(ErrorLevel, "failed to recover channel", "err", err, "type", "producer", "exchange", p.exchange.name, "attempt", attempt)
+
+			p.publishMutex.Lock()
+			p.stateMutex.Lock()
+			p.lastErr = err
+			p.stateMutex.Unlock()
+			p.publishMutex.Unlock()
+		}
+		return err
+	})
+	if connErr != nil {
+		err = connErr
+	}
+
+	// The broker is shutting down
+	if p.conn.ctx.Err() != nil {
+		return
+	}
+
+	if err != nil {
+		p.conn.log.Log(ErrorLevel, "giving up recovering channel", "err", err, "type", "producer", "exchange", p.exchange.name)
+		p.fail(err)
+		return
+	}
+
+	p.conn.log.Log(InfoLevel, "recovered channel", "type", "producer", "exchange", p.exchange.name)
+}
+
+// fail records the terminal error, fails the spooled messages and wakes up publishers blocked on the outage or flow control
+func (p *RabbitProducer) fail(err error) {
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+
+	p.stateMutex.Lock()
+	p.err = err
+	p.stateMutex.Unlock()
+	p.failSpooled(err)
+
+	close(p.recovered)
+	p.recovered = make(chan struct{})
+	p.resumeFlow()
+}
+
 // Listen for flow messages from the broker
-// If a flow message comes in we need to do some rate limiting
-func (p *RabbitProducer) listenForFlow() {
-	flowChan := p.channel.NotifyFlow(make(chan bool))
+// While the broker has paused the channel, publishes are held back according to the flow control policy
+func (p *RabbitProducer) listenForFlow(channel *amqp.Channel) {
+	flowChan := channel.NotifyFlow(make(chan bool, 1))
 	go func() {
-		for {
-			<-flowChan
-			log.Error().Str("type", "producer").Str("exchange", p.exchange.name).Msg("too many messages being produced")
+		for active := range flowChan {
+			if !active {
+				p.flowMutex.Lock()
+				p.flowPaused = true
+				p.flowMutex.Unlock()
+
+				p.conn.log.Log(ErrorLevel, "too many messages being produced", "type", "producer", "exchange", p.exchange.name)
+				p.conn.events.emit(Event{Type: FlowPaused, ConnType: "producer", Node: p.conn.currentNode(), Exchange: p.exchange.name})
+			} else {
+				p.resumeFlow()
+
+				p.conn.events.emit(Event{Type: FlowResumed, ConnType: "producer", Node: p.conn.currentNode(), Exchange: p.exchange.name})
+			}
 		}
 	}()
 }
 
-// Listen for a returned message from the broker
-// Will only be called if the mandatory flag is set and there is no queue bound, or the immediate flag is set and there is no free consumer
-func (p *RabbitProducer) listenForReturnedMessages() {
-	returnedMessageChan := p.channel.NotifyReturn(make(chan amqp.Return))
+// resumeFlow marks the channel as resumed and wakes up publishers held back by flow control
+func (p *RabbitProducer) resumeFlow() {
+	p.flowMutex.Lock()
+	defer p.flowMutex.Unlock()
+
+	p.flowPaused = false
+	close(p.flowResumed)
+	p.flowResumed = make(chan struct{})
+}
+
+// FlowState returns whether the broker currently allows the producer to publish
+func (p *RabbitProducer) FlowState() FlowState {
+	state, _, _ := p.flowState()
+	return state
+}
+
+// flowState returns the flow state along with channels which are closed once the channel is resumed and the connection is unblocked
+func (p *RabbitProducer) flowState() (FlowState, <-chan struct{}, <-chan struct{}) {
+	p.flowMutex.Lock()
+	paused := p.flowPaused
+	resumed := p.flowResumed
+	p.flowMutex.Unlock()
+
+	blocked, reason, unblocked := p.conn.blockedState()
+
+	return FlowState{Paused: paused, Blocked: blocked, Reason: reason}, resumed, unblocked
+}
+
+// Listen for returned messages and, in confirm mode, publisher confirms from the broker
+// Messages are only returned if the mandatory flag is set and there is no queue bound, or the immediate flag is set and there is no free consumer.
+// Returns and confirms are handled by the same goroutine: the broker sends the return of a message before its ack
+// and the unbuffered return channel makes sure the return is handled before the ack is received, so the confirmation fails with ErrUnroutable.
+// Once the channel closes, every unconfirmed message is failed with ErrChannelClosed
+func (p *RabbitProducer) listenForReturnedMessages(channel *amqp.Channel, confirms *confirmTracker) {
+	returnedMessageChan := channel.NotifyReturn(make(chan amqp.Return))
+
+	var confirmChan chan amqp.Confirmation
+	if confirms != nil {
+		confirmChan = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+
 	go func() {
-		for {
-			returnedMsg := <-returnedMessageChan
-			log.Error().Str("type", "producer").Str("exchange", p.exchange.name).Interface("msg", returnedMsg).Msg("message was returned")
+		for returnedMessageChan != nil || confirmChan != nil {
+			select {
+			case returnedMsg, ok := <-returnedMessageChan:
+				if !ok {
+					returnedMessageChan = nil
+					continue
+				}
+				p.handleReturn(returnedMsg, confirms)
+
+			case confirmation, ok := <-confirmChan:
+				if !ok {
+					confirmChan = nil
+					confirms.fail(ErrChannelClosed)
+					continue
+				}
+				p.conn.log.Log(TraceLevel, "received publisher confirm", "type", "producer", "exchange", p.exchange.name, "deliveryTag", confirmation.DeliveryTag, "ack", confirmation.Ack)
+				confirms.confirm(confirmation)
+			}
 		}
 	}()
 }
 
+// handleReturn fails the confirmation of a returned message and passes it to the return handler
+func (p *RabbitProducer) handleReturn(returnedMsg amqp.Return, confirms *confirmTracker) {
+	p.conn.log.Log(ErrorLevel, "message was returned", "type", "producer", "exchange", p.exchange.name, "routingKey", returnedMsg.RoutingKey, "replyCode", returnedMsg.ReplyCode, "replyText", returnedMsg.ReplyText)
+
+	// Correlate the returned message with its confirmation
+	if confirms != nil && returnedMsg.MessageId != "" {
+		confirms.returned(returnedMsg.MessageId, fmt.Errorf("%w: %s", ErrUnroutable, returnedMsg.ReplyText))
+	}
+
+	returned := returnedMsg
+	p.conn.events.emit(Event{Type: MessageReturned, ConnType: "producer", Node: p.conn.currentNode(), Exchange: p.exchange.name, Return: &returned})
+
+	if p.config.returnHandler != nil {
+		go p.config.returnHandler(returnedMsg)
+	}
+}
+
 // PublishMessage publishes a message with the given routing key
+// Errors are logged, use Publish to handle them yourself. The publish is bounded by the producer's publish timeout, see ProducerConfig.SetPublishTimeout
 func (p *RabbitProducer) PublishMessage(msg []byte, key *string, headers *amqp.Table) {
+	var routingKey string
+	if key != nil {
+		routingKey = *key
+	}
+
+	var table amqp.Table
+	if headers != nil {
+		table = *headers
+	}
+
+	ctx := context.Background()
+	if p.config.publishTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.publishTimeout)
+		defer cancel()
+	}
+
+	err := p.Publish(ctx, msg, routingKey, table)
+	if err != nil {
+		p.conn.log.Log(ErrorLevel, "error during message production", "type", "producer", "err", err, "routingKey", routingKey, "exchange", p.exchange.name)
+	}
+}
+
+/*
+Publish publishes a message with the given routing key
+In confirm mode Publish waits until the broker has acknowledged the message
+	ctx: context.Context, bounds the publish and the wait for its confirmation
+	msg: []byte, the message body
+	key: string, the routing key of the message
+	headers: amqp.Table, the message headers
+	Returns a possible error: ErrChannelClosed, ErrNacked or the context error on timeout or cancellation
+*/
+func (p *RabbitProducer) Publish(ctx context.Context, msg []byte, key string, headers amqp.Table) error {
+	return p.PublishWithOptions(ctx, msg, key, headers, nil)
+}
+
+/*
+PublishWithOptions publishes a message with the given routing key and publish options
+In confirm mode PublishWithOptions waits until the broker has acknowledged the message
+	ctx: context.Context, bounds the publish and the wait for its confirmation
+	msg: []byte, the message body
+	key: string, the routing key of the message
+	headers: amqp.Table, the message headers
+	options: *PublishOptions, the properties and flags to publish with, nil uses the producer defaults
+	Returns a possible error: ErrChannelClosed, ErrNacked or the context error on timeout or cancellation
+*/
+func (p *RabbitProducer) PublishWithOptions(ctx context.Context, msg []byte, key string, headers amqp.Table, options *PublishOptions) error {
+	confirmation, err := p.publish(ctx, msg, key, headers, options)
+	if err != nil {
+		return err
+	}
+
+	// Not in confirm mode, the message is handed to the broker
+	if confirmation == nil {
+		return nil
+	}
+
+	return confirmation.Wait(ctx)
+}
+
+/*
+PublishWithConfirmation publishes a message with the given routing key and returns its pending broker confirmation
+	msg: []byte, the message body
+	key: string, the routing key of the message
+	headers: amqp.Table, the message headers
+	Returns the Confirmation to wait on and a possible error, ErrConfirmModeDisabled if the producer is not in confirm mode
+*/
+func (p *RabbitProducer) PublishWithConfirmation(msg []byte, key string, headers amqp.Table) (*Confirmation, error) {
+	if !p.config.confirmMode {
+		return nil, ErrConfirmModeDisabled
+	}
+
+	return p.publish(context.Background(), msg, key, headers, nil)
+}
+
+/*
+PublishBatch publishes a batch of messages, each with its own routing key, headers and options
+In confirm mode PublishBatch publishes every message before waiting until the broker has confirmed them all
+	ctx: context.Context, bounds the publishes and the wait for their confirmations
+	messages: []*Message, the messages to publish, messages without options use the producer defaults
+	Returns a *BatchError listing the messages which failed, which can be retried, or nil if every message was published
+*/
+func (p *RabbitProducer) PublishBatch(ctx context.Context, messages []*Message) error {
+	p.conn.log.Log(DebugLevel, "publishing batch", "type", "producer", "exchange", p.exchange.name, "messages", len(messages))
+
+	return publishBatch(ctx, messages, func(ctx context.Context, message *Message) (*Confirmation, error) {
+		return p.publish(ctx, message.Body, message.RoutingKey, message.Headers, message.Options)
+	})
+}
+
+// publish passes a message through the publish middleware, returning its confirmation when the producer is in confirm mode
+// The producer's default publish options are used when options is nil
+func (p *RabbitProducer) publish(ctx context.Context, msg []byte, key string, headers amqp.Table, options *PublishOptions) (*Confirmation, error) {
+	if options == nil {
+		options = p.config.publishOptions
+	}
+
+	return p.publishChain(ctx, &Message{
+		Body:       msg,
+		RoutingKey: key,
+		Headers:    headers,
+		Options:    options,
+	})
+}
+
+// publishMessage hands a message to the broker, it is the innermost PublishFunc of the publish middleware
+func (p *RabbitProducer) publishMessage(ctx context.Context, message *Message) (confirmation *Confirmation, err error) {
+	if message == nil {
+		return nil, ErrNilMessage
+	}
+	msg, key, headers, options := message.Body, message.RoutingKey, message.Headers, message.Options
+
+	// Trace the message, its trace context is propagated in the headers
+	ctx, span, headers := startPublishSpan(ctx, p.conn.tracer, p.exchange.name, key, headers)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+
+		p.conn.metrics.MessagePublished(p.exchange.name, key, err)
+	}()
+
+	p.conn.log.Log(TraceLevel, "producing message", "type", "producer", "routingKey", key, "exchange", p.exchange.name, "msgSize", len(msg))
 
-	log.Trace().Str("type", "producer").Str("routingKey", *key).Str("exchange", p.exchange.name).Int("msgSize", len(msg)).Msg("producing message")
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+
+	for {
+		// Block until the producer has recovered from an outage
+		for !p.available && !p.closed && p.err == nil && p.config.outagePolicy == BlockDuringOutage {
+			recovered := p.recovered
+			p.publishMutex.Unlock()
+			select {
+			case <-recovered:
+			case <-ctx.Done():
+			}
+			p.publishMutex.Lock()
+
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		// Do not publish if the caller gave up in the meantime
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		if p.closed {
+			return nil, ErrChannelClosed
+		}
+
+		// The producer gave up recovering from the outage
+		if p.err != nil {
+			return nil, p.err
+		}
+
+		// Spool the message during an outage, and until the spooled messages have been replayed to keep them in order
+		if !p.available || (!p.replayed && p.config.outagePolicy == BufferDuringOutage) {
+			if p.config.outagePolicy == BufferDuringOutage {
+				return p.spoolMessage(key, options.publishing(msg, headers), options)
+			}
+			return nil, ErrProducerUnavailable
+		}
+
+		// Hold back the message while the broker does not allow publishing
+		state, resumed, unblocked := p.flowState()
+		if state.Active() || p.config.flowPolicy == IgnoreFlowControl {
+			// With a configured store, messages are kept until the broker has confirmed them
+			if p.config.spool != nil && p.confirms != nil {
+				return p.publishDurably(key, options.publishing(msg, headers), options)
+			}
+			return p.publishOnChannel(key, options.publishing(msg, headers), options.mandatory, options.immediate)
+		}
+		if p.config.flowPolicy == FailDuringFlowControl {
+			if state.Paused {
+				return nil, ErrFlowPaused
+			}
+			return nil, ErrConnectionBlocked
+		}
+
+		// Block until the broker allows publishing again, then check the producer's state again
+		p.publishMutex.Unlock()
+		select {
+		case <-resumed:
+		case <-unblocked:
+		case <-ctx.Done():
+		}
+		p.publishMutex.Lock()
+	}
+}
+
+// publishOnChannel publishes a message on the current channel, the publish mutex must be held
+func (p *RabbitProducer) publishOnChannel(key string, publishing amqp.Publishing, mandatory bool, immediate bool) (*Confirmation, error) {
+	// Register the confirmation before publishing, the broker might confirm before Publish returns
+	var confirmation *Confirmation
+	if p.confirms != nil {
+		// A return is correlated with the confirmation by the message ID, so mandatory messages need one
+		var messageID string
+		if mandatory {
+			if publishing.MessageId == "" {
+				publishing.MessageId = newMessageID()
+			}
+			messageID = publishing.MessageId
+		}
+		confirmation = p.confirms.add(key, messageID)
+	}
 
 	err := p.channel.Publish(
 		p.exchange.name,
-		*key,
-		false,
-		false,
-		amqp.Publishing{
-			DeliveryMode: amqp.Transient,
-			ContentType:  "plaintext",
-			Body:         msg,
-			Timestamp:    time.Now(),
-			Headers:      *headers,
-		},
+		key,
+		mandatory,
+		immediate,
+		publishing,
 	)
 	if err != nil {
-		log.Error().Str("type", "producer").AnErr("err", err).Str("routingKey", *key).Str("exchange", p.exchange.name).Msg("error during message production")
+		if confirmation != nil {
+			p.confirms.remove(confirmation)
+		}
+		if err == amqp.ErrClosed {
+			err = ErrChannelClosed
+		}
+		return nil, err
+	}
+
+	return confirmation, nil
+}
+
+// spoolMessage stores a message published during an outage, the publish mutex must be held
+func (p *RabbitProducer) spoolMessage(key string, publishing amqp.Publishing, options *PublishOptions) (*Confirmation, error) {
+	_, confirmation, err := p.appendToSpool(key, publishing, options)
+	if err != nil {
+		return nil, err
+	}
+
+	p.conn.log.Log(DebugLevel, "spooled message during outage", "type", "producer", "routingKey", key, "exchange", p.exchange.name, "spooled", p.spool.Len())
+	return confirmation, nil
+}
+
+// publishDurably spools a message before publishing it, so it is replayed if the channel is lost before the broker confirms it
+// The publish mutex must be held
+func (p *RabbitProducer) publishDurably(key string, publishing amqp.Publishing, options *PublishOptions) (*Confirmation, error) {
+	message, confirmation, err := p.appendToSpool(key, publishing, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.publishSpooled(message)
+	if err == nil {
+		return confirmation, nil
+	}
+
+	// The message is replayed once the channel is recovered
+	if isClosedError(err) {
+		p.conn.log.Log(DebugLevel, "failed to publish spooled message, replaying it once the channel is recovered", "type", "producer", "err", err, "exchange", p.exchange.name, "routingKey", key)
+		return confirmation, nil
+	}
+
+	// The message will never be published
+	p.dropSpooled(message.ID, err)
+	return nil, err
+}
+
+// appendToSpool appends a message to the spool, the publish mutex must be held
+// In confirm mode the confirmation handed to the publisher is registered for the message, otherwise it is nil
+func (p *RabbitProducer) appendToSpool(key string, publishing amqp.Publishing, options *PublishOptions) (*SpooledMessage, *Confirmation, error) {
+	// Reject messages the broker would never accept, rather than replaying them forever
+	err := publishing.Headers.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message := &SpooledMessage{
+		RoutingKey: key,
+		Publishing: publishing,
+		Mandatory:  options.mandatory,
+		Immediate:  options.immediate,
+		SpooledAt:  time.Now(),
+	}
+	err = p.spool.Append(message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !p.config.confirmMode {
+		return message, nil, nil
+	}
+
+	confirmation := newConfirmation(0)
+	p.spooled[message.ID] = &spooledConfirmation{confirmation: confirmation}
+	return message, confirmation, nil
+}
+
+// replaySpool publishes the spooled messages in order, the publish mutex must be held
+func (p *RabbitProducer) replaySpool() {
+	messages, err := p.spool.Messages()
+	if err != nil {
+		p.conn.log.Log(ErrorLevel, "failed to read spooled messages", "type", "producer", "err", err, "exchange", p.exchange.name)
+		return
+	}
+
+	for i, message := range messages {
+		err = p.publishSpooled(message)
+		if err == nil {
+			continue
+		}
+
+		// Replay the rest once the channel is recovered
+		if isClosedError(err) {
+			p.conn.log.Log(ErrorLevel, "failed to replay spooled messages", "type", "producer", "err", err, "exchange", p.exchange.name, "spooled", len(messages)-i)
+			return
+		}
+
+		// The message will never be published, drop it so it does not hold up the rest
+		p.conn.log.Log(ErrorLevel, "dropping spooled message which cannot be published", "type", "producer", "err", err, "exchange", p.exchange.name, "routingKey", message.RoutingKey)
+		p.dropSpooled(message.ID, err)
+	}
+
+	if len(messages) > 0 {
+		p.conn.log.Log(InfoLevel, "replayed spooled messages", "type", "producer", "exchange", p.exchange.name, "replayed", len(messages))
+	}
+	p.replayed = true
+}
+
+// publishSpooled publishes a spooled message on the current channel, the publish mutex must be held
+// Without confirm mode the message is removed from the spool once published, otherwise once the broker has confirmed it
+func (p *RabbitProducer) publishSpooled(message *SpooledMessage) error {
+	confirmation, err := p.publishOnChannel(message.RoutingKey, message.Publishing, message.Mandatory, message.Immediate)
+	if err != nil {
+		return err
+	}
+
+	if confirmation == nil {
+		err = p.spool.Remove(message.ID)
+		if err != nil {
+			p.conn.log.Log(ErrorLevel, "failed to remove message from spool", "type", "producer", "err", err, "exchange", p.exchange.name)
+		}
+		return nil
+	}
+
+	if spooled, ok := p.spooled[message.ID]; ok {
+		spooled.pending = confirmation
+	}
+	p.spooling.Add(1)
+	go p.awaitSpooled(message.ID, confirmation)
+	return nil
+}
+
+// dropSpooled removes a message from the spool and fails the confirmation handed to its publisher, the publish mutex must be held
+func (p *RabbitProducer) dropSpooled(id uint64, err error) {
+	removeErr := p.spool.Remove(id)
+	if removeErr != nil {
+		p.conn.log.Log(ErrorLevel, "failed to remove message from spool", "type", "producer", "err", removeErr, "exchange", p.exchange.name)
+	}
+
+	if spooled, ok := p.spooled[id]; ok {
+		delete(p.spooled, id)
+		spooled.confirmation.resolve(err)
+	}
+}
+
+// isClosedError returns whether a publish failed because the channel or connection was closed, rather than because of the message
+func isClosedError(err error) bool {
+	var amqpErr *amqp.Error
+	var netErr net.Error
+	return errors.Is(err, ErrChannelClosed) || errors.Is(err, amqp.ErrClosed) || errors.As(err, &amqpErr) || errors.As(err, &netErr)
+}
+
+// awaitSpooled waits for the confirmation of a spooled message on a channel and hands the result to its publisher
+// A message kept in a configured store stays spooled when the channel closes first, so it is replayed once the channel is recovered
+func (p *RabbitProducer) awaitSpooled(id uint64, confirmation *Confirmation) {
+	defer p.spooling.Done()
+	<-confirmation.Done()
+
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+
+	spooled := p.spooled[id]
+	durable := p.config.spool != nil
+	if confirmation.err == ErrChannelClosed && durable && !p.closed && p.err == nil {
+		if spooled != nil && spooled.pending == confirmation {
+			spooled.pending = nil
+		}
+		return
+	}
+
+	if confirmation.err != ErrChannelClosed || !durable {
+		err := p.spool.Remove(id)
+		if err != nil {
+			p.conn.log.Log(ErrorLevel, "failed to remove message from spool", "type", "producer", "err", err, "exchange", p.exchange.name)
+		}
+	}
+
+	if spooled != nil {
+		delete(p.spooled, id)
+		spooled.confirmation.resolve(confirmation.err)
+	}
+}
+
+// failSpooled fails the confirmations of the spooled messages which are not in flight, the publish mutex must be held
+// The messages are dropped, unless they are kept in a configured store to be replayed by the next run
+func (p *RabbitProducer) failSpooled(err error) {
+	for id, spooled := range p.spooled {
+		if spooled.pending == nil {
+			delete(p.spooled, id)
+			spooled.confirmation.resolve(err)
+		}
+	}
+
+	if p.config.spool != nil {
+		return
+	}
+
+	messages, _ := p.spool.Messages()
+	for _, message := range messages {
+		if _, ok := p.spooled[message.ID]; !ok {
+			p.spool.Remove(message.ID)
+		}
 	}
 }
 
+/*
+Spooled returns the messages the producer has spooled, in the order they will be replayed
+Messages are spooled during an outage with BufferDuringOutage, and with a configured store in confirm mode until they are confirmed
+	Returns the spooled messages and a possible error reading them from the store
+*/
+func (p *RabbitProducer) Spooled() ([]*SpooledMessage, error) {
+	return p.spool.Messages()
+}
+
 // ReconnectChannel tries to re-open this producer's channel
-func (p *RabbitProducer) ReconnectChannel() {
-	p.openChannel(p.conn)
+func (p *RabbitProducer) ReconnectChannel() error {
+	return p.setup()
 }
 
 // Shutdown closes this producer's channel
+// Spooled messages which have not been published yet are failed with ErrChannelClosed, a spool store keeps them for the next run
 func (p *RabbitProducer) Shutdown() error {
-	log.Info().Str("type", "producer").Str("exchange", p.exchange.name).Msg("shutting down")
-	return p.channel.Close()
+	p.conn.log.Log(InfoLevel, "shutting down", "type", "producer", "exchange", p.exchange.name)
+
+	// The channel is missing if the producer never connected
+	channel, _ := p.stop()
+	var err error
+	if channel != nil {
+		err = channel.Close()
+	}
+	p.closeSpool()
+	return err
+}
+
+// drain stops publishing, waits for the outstanding confirmations and closes the channel
+// Returns the context's error if the confirmations did not arrive in time, the channel is closed regardless
+func (p *RabbitProducer) drain(ctx context.Context) error {
+	p.conn.log.Log(InfoLevel, "draining", "type", "producer", "exchange", p.exchange.name)
+
+	channel, confirms := p.stop()
+
+	var err error
+	if confirms != nil {
+		for _, confirmation := range confirms.outstanding() {
+			select {
+			case <-confirmation.Done():
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	var closeErr error
+	if channel != nil {
+		closeErr = channel.Close()
+	}
+	p.closeSpool()
+	if err != nil {
+		return err
+	}
+	if closeErr == amqp.ErrClosed {
+		return nil
+	}
+	return closeErr
+}
+
+// closeSpool waits until the confirmations of the spooled messages have been handled and closes the spool store
+func (p *RabbitProducer) closeSpool() {
+	p.spooling.Wait()
+
+	err := p.spool.Close()
+	if err != nil {
+		p.conn.log.Log(ErrorLevel, "failed to close spool", "type", "producer", "err", err, "exchange", p.exchange.name)
+	}
+}
+
+// stop marks the producer as shut down, fails the spooled messages with ErrChannelClosed and wakes up publishers blocked on the outage or flow control
+// Returns the channel and the confirmations of the producer
+func (p *RabbitProducer) stop() (*amqp.Channel, *confirmTracker) {
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+
+	p.stateMutex.Lock()
+	p.closed = true
+	p.stateMutex.Unlock()
+	p.failSpooled(ErrChannelClosed)
+
+	close(p.recovered)
+	p.recovered = make(chan struct{})
+	p.resumeFlow()
+
+	return p.channel, p.confirms
 }
@@ -0,0 +1,128 @@
+package alice
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// OutagePolicy determines what happens to messages published while a producer is recovering its channel
+type OutagePolicy int
+
+const (
+	// FailDuringOutage makes publishes fail with ErrProducerUnavailable
+	FailDuringOutage OutagePolicy = iota
+
+	// BlockDuringOutage blocks publishes until the producer has recovered or their context is done
+	BlockDuringOutage
+
+	// BufferDuringOutage spools messages, in memory unless a spool store is set, and publishes them in order once the producer has recovered
+	BufferDuringOutage
+)
+
+// FlowControlPolicy determines what happens to messages published while the broker has paused the producer's channel
+// with channel.flow or blocked its connection with connection.blocked, e.g. because it is low on memory or disk space
+type FlowControlPolicy int
+
+const (
+	// BlockDuringFlowControl blocks publishes until the broker allows publishing again or their context is done
+	BlockDuringFlowControl FlowControlPolicy = iota
+
+	// FailDuringFlowControl makes publishes fail with ErrFlowPaused or ErrConnectionBlocked
+	FailDuringFlowControl
+
+	// IgnoreFlowControl keeps publishing, publishes block on the socket once the broker stops reading from a blocked connection
+	IgnoreFlowControl
+)
+
+// ReturnHandler handles a message the broker returned because it was published as mandatory and could not be routed to any queue
+type ReturnHandler func(returned amqp.Return)
+
+// ProducerConfig is a config structure to use when creating a producer
+type ProducerConfig struct {
+	confirmMode    bool              // Whether the producer channel is put into confirm mode
+	publishOptions *PublishOptions   // The options messages are published with unless others are given
+	outagePolicy   OutagePolicy      // What happens to publishes while the channel is being recovered
+	outageBuffer   int               // Maximum number of messages buffered during an outage
+	flowPolicy     FlowControlPolicy // What happens to publishes while the broker does not allow publishing
+	spool          SpoolStore        // Stores the spooled messages, nil to spool in memory
+	publishTimeout time.Duration     // Bounds PublishMessage, 0 for no bound
+
+	middleware    []PublishMiddleware // Wraps the publishes of the producer
+	returnHandler ReturnHandler       // Handles returned messages, nil to only log them
+}
+
+// DefaultProducerConfig is the configuration used by CreateProducer.
+//	confirmMode: false, publishOptions: CreateDefaultPublishOptions(), outagePolicy: FailDuringOutage, outageBuffer: 1000, flowPolicy: BlockDuringFlowControl,
+//	publishTimeout: 30 seconds
+var DefaultProducerConfig = CreateProducerConfig()
+
+// CreateProducerConfig creates a producer configuration with the default settings
+func CreateProducerConfig() *ProducerConfig {
+	return &ProducerConfig{
+		confirmMode:    false,
+		publishOptions: CreateDefaultPublishOptions(),
+		outagePolicy:   FailDuringOutage,
+		outageBuffer:   1000,
+		flowPolicy:     BlockDuringFlowControl,
+		publishTimeout: time.Second * 30,
+	}
+}
+
+// SetConfirmMode sets whether the producer channel is put into confirm mode.
+// In confirm mode the broker acknowledges every published message, which can be awaited through PublishWithConfirmation.
+func (config *ProducerConfig) SetConfirmMode(confirmMode bool) {
+	config.confirmMode = confirmMode
+}
+
+// SetPublishOptions sets the options messages are published with when no options are passed to the publish call
+// nil resets them to CreateDefaultPublishOptions
+func (config *ProducerConfig) SetPublishOptions(options *PublishOptions) {
+	if options == nil {
+		options = CreateDefaultPublishOptions()
+	}
+	config.publishOptions = options
+}
+
+// SetOutagePolicy sets what happens to messages published while the producer is recovering from a channel or connection loss
+func (config *ProducerConfig) SetOutagePolicy(policy OutagePolicy) {
+	config.outagePolicy = policy
+}
+
+// SetOutageBuffer sets the maximum number of messages spooled in memory during an outage when using BufferDuringOutage without a spool store
+func (config *ProducerConfig) SetOutageBuffer(size int) {
+	config.outageBuffer = size
+}
+
+// SetSpool sets the store the producer spools messages in and sets the outage policy to BufferDuringOutage
+// Messages published during an outage are kept in the store until they have been replayed, in confirm mode every message is kept until the broker confirmed it.
+// Spooled messages are replayed in order once the channel is (re-)opened, also those left in the store by a previous run, see CreateFileSpool.
+// A store must only be used by a single producer, so do not create multiple producers with this configuration.
+func (config *ProducerConfig) SetSpool(store SpoolStore) {
+	config.spool = store
+	config.outagePolicy = BufferDuringOutage
+}
+
+// SetFlowControlPolicy sets what happens to messages published while the broker has paused the producer's channel or blocked its connection
+func (config *ProducerConfig) SetFlowControlPolicy(policy FlowControlPolicy) {
+	config.flowPolicy = policy
+}
+
+// SetPublishTimeout sets how long PublishMessage waits for a blocked publish and, in confirm mode, for the broker's confirmation
+// PublishMessage takes no context, so without a timeout a confirmation the broker never sends blocks it forever. 0 disables the timeout.
+func (config *ProducerConfig) SetPublishTimeout(timeout time.Duration) {
+	config.publishTimeout = timeout
+}
+
+// SetReturnHandler sets the handler of messages the broker returned, it is called in a new goroutine for every returned message
+// Messages are only returned when published with the mandatory flag, see PublishOptions.SetMandatory.
+// In confirm mode the publish of a returned message also fails with ErrUnroutable.
+func (config *ProducerConfig) SetReturnHandler(handler ReturnHandler) {
+	config.returnHandler = handler
+}
+
+// AddMiddleware adds middleware wrapping the publishes of producers created with this configuration
+// It runs inside the broker's publish middleware, in the order it was added, see PublishMiddleware
+func (config *ProducerConfig) AddMiddleware(middleware ...PublishMiddleware) {
+	config.middleware = append(config.middleware, middleware...)
+}
@@ -0,0 +1,136 @@
+// Package prometheus implements an alice.MetricsCollector exposing the measurements as Prometheus metrics
+package prometheus
+
+import (
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/thijsheijden/alice"
+)
+
+// A Collector is an alice.MetricsCollector and a prometheus.Collector
+// Register it with a Prometheus registry and set it on the connection config with SetMetricsCollector
+type Collector struct {
+	published       *prom.CounterVec   // Messages published, by exchange, routing key and result
+	confirmed       *prom.HistogramVec // Publisher confirm latency, by exchange, routing key and result
+	delivered       *prom.CounterVec   // Messages delivered, by queue, routing key and consumer tag
+	handled         *prom.CounterVec   // Messages handled, by queue, routing key, consumer tag and disposition
+	handlerDuration *prom.HistogramVec // Message handler duration, by queue, routing key and consumer tag
+	inFlight        *prom.GaugeVec     // Running message handlers, by queue, routing key and consumer tag
+	reconnects      *prom.CounterVec   // Reconnection attempts, by connection and result
+}
+
+/*
+CreateCollector creates a collector
+	namespace: string, the namespace of the metric names, e.g. "alice" gives alice_messages_published_total
+	Returns *Collector
+*/
+func CreateCollector(namespace string) *Collector {
+	consumerLabels := []string{"queue", "routing_key", "consumer_tag"}
+
+	return &Collector{
+		published: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_published_total",
+			Help:      "Number of messages published, by result.",
+		}, []string{"exchange", "routing_key", "result"}),
+		confirmed: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "publish_confirm_duration_seconds",
+			Help:      "Time between publishing a message and receiving the publisher confirm, by result.",
+			Buckets:   prom.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"exchange", "routing_key", "result"}),
+		delivered: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_delivered_total",
+			Help:      "Number of messages delivered to consumers.",
+		}, consumerLabels),
+		handled: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_handled_total",
+			Help:      "Number of messages handled, by the disposition they were acknowledged with.",
+		}, append(consumerLabels, "disposition")),
+		handlerDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Time message handlers took.",
+			Buckets:   prom.DefBuckets,
+		}, consumerLabels),
+		inFlight: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "handlers_in_flight",
+			Help:      "Number of message handlers which are running.",
+		}, consumerLabels),
+		reconnects: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnect_attempts_total",
+			Help:      "Number of attempts to re-establish a connection, by result.",
+		}, []string{"connection", "result"}),
+	}
+}
+
+// Describe sends the descriptors of the metrics to the channel
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	c.published.Describe(ch)
+	c.confirmed.Describe(ch)
+	c.delivered.Describe(ch)
+	c.handled.Describe(ch)
+	c.handlerDuration.Describe(ch)
+	c.inFlight.Describe(ch)
+	c.reconnects.Describe(ch)
+}
+
+// Collect sends the metrics to the channel
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	c.published.Collect(ch)
+	c.confirmed.Collect(ch)
+	c.delivered.Collect(ch)
+	c.handled.Collect(ch)
+	c.handlerDuration.Collect(ch)
+	c.inFlight.Collect(ch)
+	c.reconnects.Collect(ch)
+}
+
+// MessagePublished counts a published message
+func (c *Collector) MessagePublished(exchange string, routingKey string, err error) {
+	c.published.WithLabelValues(exchange, routingKey, result(err == nil)).Inc()
+}
+
+// PublishConfirmed observes the latency of a publisher confirm
+func (c *Collector) PublishConfirmed(exchange string, routingKey string, acked bool, latency time.Duration) {
+	confirmResult := "ack"
+	if !acked {
+		confirmResult = "nack"
+	}
+	c.confirmed.WithLabelValues(exchange, routingKey, confirmResult).Observe(latency.Seconds())
+}
+
+// MessageDelivered counts a delivered message
+func (c *Collector) MessageDelivered(queue string, routingKey string, consumerTag string) {
+	c.delivered.WithLabelValues(queue, routingKey, consumerTag).Inc()
+}
+
+// HandlerStarted counts a running message handler
+func (c *Collector) HandlerStarted(queue string, routingKey string, consumerTag string) {
+	c.inFlight.WithLabelValues(queue, routingKey, consumerTag).Inc()
+}
+
+// MessageHandled counts a handled message and observes the duration of its handler
+func (c *Collector) MessageHandled(queue string, routingKey string, consumerTag string, disposition alice.Disposition, duration time.Duration) {
+	c.inFlight.WithLabelValues(queue, routingKey, consumerTag).Dec()
+	c.handled.WithLabelValues(queue, routingKey, consumerTag, disposition.String()).Inc()
+	c.handlerDuration.WithLabelValues(queue, routingKey, consumerTag).Observe(duration.Seconds())
+}
+
+// ReconnectAttempted counts a reconnection attempt
+func (c *Collector) ReconnectAttempted(connType string, err error) {
+	c.reconnects.WithLabelValues(connType, result(err == nil)).Inc()
+}
+
+// result returns the result label value
+func result(success bool) string {
+	if success {
+		return "success"
+	}
+	return "error"
+}
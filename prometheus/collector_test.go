@@ -0,0 +1,47 @@
+package prometheus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thijsheijden/alice"
+)
+
+func TestCollector(t *testing.T) {
+	collector := CreateCollector("alice")
+
+	// The collector can be set on a connection config
+	var metrics alice.MetricsCollector = collector
+	config := alice.CreateConfig("guest", "guest", "localhost", 5672, true, time.Second)
+	config.SetMetricsCollector(metrics)
+
+	registry := prom.NewRegistry()
+	registry.MustRegister(collector)
+
+	collector.MessagePublished("orders", "created", nil)
+	collector.MessagePublished("orders", "created", errors.New("channel was closed"))
+	collector.HandlerStarted("orders", "created", "worker")
+	collector.MessageHandled("orders", "created", "worker", alice.Requeue, time.Millisecond)
+	collector.ReconnectAttempted("producer", nil)
+
+	if got := testutil.ToFloat64(collector.published.WithLabelValues("orders", "created", "error")); got != 1 {
+		t.Errorf("failed publishes = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(collector.handled.WithLabelValues("orders", "created", "worker", "requeue")); got != 1 {
+		t.Errorf("requeued messages = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(collector.inFlight.WithLabelValues("orders", "created", "worker")); got != 0 {
+		t.Errorf("handlers in flight = %v, want 0", got)
+	}
+
+	count, err := testutil.GatherAndCount(registry, "alice_reconnect_attempts_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("reconnect series = %d, want 1", count)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/thijsheijden/alice/prometheus
+
+go 1.16
+
+require (
+	github.com/prometheus/client_golang v1.12.2
+	github.com/thijsheijden/alice v0.0.0-00010101000000-000000000000
+)
+
+replace github.com/thijsheijden/alice => ../
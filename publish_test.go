@@ -0,0 +1,201 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPublishContext(t *testing.T) {
+	config := CreateProducerConfig()
+	config.SetOutagePolicy(BlockDuringOutage)
+
+	p := newTestProducer(t, config)
+
+	// A cancelled context fails the publish before it reaches the broker
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Publish(ctx, []byte("cancelled"), "key", nil); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+
+	// The deadline bounds the wait for the producer's channel
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := p.Publish(ctx, []byte("late"), "key", nil); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPublishMessageLogsErrors(t *testing.T) {
+	recorder := &recordingLogger{}
+	config := CreateConfig("guest", "guest", "localhost", 5672, false, 0)
+	config.SetLogger(recorder)
+
+	// AMQP has no unsigned 32 bit header values, so the channel rejects the message before sending it
+	p := newProducer(newTestConnection(config), &Exchange{name: "test-exchange"}, CreateProducerConfig())
+	p.channel = &amqp.Channel{}
+	p.available = true
+	key := "key"
+	p.PublishMessage([]byte("lost"), &key, &amqp.Table{"count": uint32(3)})
+
+	// The error is logged rather than returned
+	fields := recorder.fields("error error during message production")
+	if fields == nil {
+		t.Fatalf("messages = %v, want the production error", recorder.messages)
+	}
+	if fields["routingKey"] != "key" || fields["err"] == nil {
+		t.Errorf("logged %v, want the routing key and the err", fields)
+	}
+}
+
+func TestPublishMessageTimeout(t *testing.T) {
+	recorder := &recordingLogger{}
+	config := CreateConfig("guest", "guest", "localhost", 5672, false, 0)
+	config.SetLogger(recorder)
+
+	producerConfig := CreateProducerConfig()
+	producerConfig.SetConfirmMode(true)
+	producerConfig.SetPublishTimeout(time.Millisecond * 20)
+	p := newProducer(newTestConnection(config), &Exchange{name: "test-exchange"}, producerConfig)
+
+	// The broker never confirms the message
+	p.publishChain = func(ctx context.Context, message *Message) (*Confirmation, error) {
+		return newConfirmation(1), nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.PublishMessage([]byte("unconfirmed"), nil, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("PublishMessage kept waiting for the confirmation")
+	}
+	if fields := recorder.fields("error error during message production"); fields == nil || fields["err"] != context.DeadlineExceeded {
+		t.Errorf("logged %v, want %v", fields, context.DeadlineExceeded)
+	}
+}
+
+func TestPublishMandatory(t *testing.T) {
+	config := CreateProducerConfig()
+	config.SetConfirmMode(true)
+	p := newTestProducer(t, config)
+	published := connectFakeBroker(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// A routed message is acked
+	options := CreateDefaultPublishOptions()
+	options.SetMandatory(true)
+	if err := p.PublishWithOptions(ctx, []byte("routed"), "key", nil, options); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unroutable message is returned, which fails its publish
+	options.SetMessageID("order-1")
+	err := p.PublishWithOptions(ctx, []byte("lost"), fakeUnroutableKey, amqp.Table{"tenant": "acme"}, options)
+	if !errors.Is(err, ErrUnroutable) {
+		t.Errorf("err = %v, want %v", err, ErrUnroutable)
+	}
+
+	// Consumers receive the headers as published, messages without a message ID are given a generated one
+	routed := <-published
+	if routed.headers != nil {
+		t.Errorf("headers = %v, want none", routed.headers)
+	}
+	if routed.messageID == "" {
+		t.Error("expected the mandatory message to be given a message ID")
+	}
+
+	lost := <-published
+	if want := map[string]string{"tenant": "acme"}; !reflect.DeepEqual(lost.headers, want) {
+		t.Errorf("headers = %v, want %v", lost.headers, want)
+	}
+	if lost.messageID != "order-1" {
+		t.Errorf("message ID = %q, want %q", lost.messageID, "order-1")
+	}
+}
+
+func TestMockPublishContext(t *testing.T) {
+	broker := CreateMockBroker()
+	exchange, _ := CreateExchange("test-exchange", Direct, false, true, false, false, nil)
+	queue := CreateQueue(exchange, "test-queue", false, false, true, false, nil)
+
+	c, _ := broker.CreateConsumer(queue, "key", "")
+	p, _ := broker.CreateProducer(exchange)
+
+	// Nobody consumes the queue yet, so the publish waits until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := p.Publish(ctx, []byte("late"), "key", nil); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	received := make(chan string, 1)
+	go c.ConsumeMessages(nil, true, func(delivery amqp.Delivery) {
+		received <- string(delivery.Body)
+	})
+
+	if err := p.Publish(context.Background(), []byte("delivered"), "key", amqp.Table{"tenant": "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if body := <-received; body != "delivered" {
+		t.Errorf("received %q, want %q", body, "delivered")
+	}
+}
+
+func TestMockShutdownDuringPublish(t *testing.T) {
+	broker := CreateMockBroker()
+	exchange, _ := CreateExchange("test-exchange", Direct, false, true, false, false, nil)
+	queue := CreateQueue(exchange, "test-queue", false, false, true, false, nil)
+
+	c, _ := broker.CreateConsumer(queue, "key", "")
+	p, _ := broker.CreateProducer(exchange)
+
+	consumed := make(chan struct{})
+	go func() {
+		c.Consume(nil, func(ctx context.Context, delivery amqp.Delivery) error {
+			return nil
+		})
+		close(consumed)
+	}()
+
+	// Publishes racing the shutdown either go through or fail with ErrBrokerShutdown
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- p.Publish(context.Background(), []byte("racing"), "key", nil)
+		}()
+	}
+	if err := broker.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil && err != ErrBrokerShutdown {
+			t.Errorf("err = %v, want nil or %v", err, ErrBrokerShutdown)
+		}
+	}
+
+	// Shutting down ends consumption
+	select {
+	case <-consumed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("consumer did not stop after the shutdown")
+	}
+
+	if err := p.Publish(context.Background(), []byte("late"), "key", nil); err != ErrBrokerShutdown {
+		t.Errorf("err = %v, want %v", err, ErrBrokerShutdown)
+	}
+	if err := broker.Shutdown(context.Background()); err != nil {
+		t.Errorf("second shutdown returned %v", err)
+	}
+}
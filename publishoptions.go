@@ -0,0 +1,127 @@
+package alice
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublishOptions models the properties and flags a message is published with
+type PublishOptions struct {
+	deliveryMode    uint8  // amqp.Transient or amqp.Persistent
+	contentType     string // MIME content type of the body
+	contentEncoding string // MIME content encoding of the body
+	priority        uint8  // Message priority, 0 to 9
+	expiration      string // Message TTL in milliseconds, empty for no expiration
+	messageID       string // Application message identifier
+	correlationID   string // Application correlation identifier
+	replyTo         string // Address to reply to
+	messageType     string // Application message type name
+	appID           string // Identifier of the publishing application
+	userID          string // Creating user ID, validated by the broker
+	mandatory       bool   // Should the broker return the message if it cannot be routed to a queue?
+	immediate       bool   // Should the broker return the message if it cannot be delivered to a consumer right away?
+}
+
+// CreateDefaultPublishOptions creates and returns publish options with the following parameters:
+//	deliveryMode: amqp.Transient, contentType: "plaintext", priority: 0, no expiration, mandatory: false, immediate: false
+func CreateDefaultPublishOptions() *PublishOptions {
+	return &PublishOptions{
+		deliveryMode: amqp.Transient,
+		contentType:  "plaintext",
+	}
+}
+
+// SetDeliveryMode sets the delivery mode, amqp.Transient or amqp.Persistent
+func (o *PublishOptions) SetDeliveryMode(deliveryMode uint8) {
+	o.deliveryMode = deliveryMode
+}
+
+// SetContentType sets the MIME content type of the message body
+func (o *PublishOptions) SetContentType(contentType string) {
+	o.contentType = contentType
+}
+
+// SetContentEncoding sets the MIME content encoding of the message body
+func (o *PublishOptions) SetContentEncoding(contentEncoding string) {
+	o.contentEncoding = contentEncoding
+}
+
+// SetPriority sets the message priority (0 to 9)
+func (o *PublishOptions) SetPriority(priority uint8) {
+	o.priority = priority
+}
+
+// SetExpiration sets after how long an unconsumed message expires, 0 means it never expires
+func (o *PublishOptions) SetExpiration(expiration time.Duration) {
+	if expiration <= 0 {
+		o.expiration = ""
+		return
+	}
+	o.expiration = strconv.FormatInt(expiration.Milliseconds(), 10)
+}
+
+// SetMessageID sets the application message identifier
+// In confirm mode the returns of mandatory messages are correlated with their publishes by the message ID, so it should be unique
+func (o *PublishOptions) SetMessageID(messageID string) {
+	o.messageID = messageID
+}
+
+// SetCorrelationID sets the application correlation identifier
+func (o *PublishOptions) SetCorrelationID(correlationID string) {
+	o.correlationID = correlationID
+}
+
+// SetReplyTo sets the address consumers should reply to
+func (o *PublishOptions) SetReplyTo(replyTo string) {
+	o.replyTo = replyTo
+}
+
+// SetType sets the application message type name
+func (o *PublishOptions) SetType(messageType string) {
+	o.messageType = messageType
+}
+
+// SetAppID sets the identifier of the publishing application
+func (o *PublishOptions) SetAppID(appID string) {
+	o.appID = appID
+}
+
+// SetUserID sets the user ID of the publisher, the broker rejects messages whose user ID does not match the connection user
+func (o *PublishOptions) SetUserID(userID string) {
+	o.userID = userID
+}
+
+// SetMandatory sets whether the broker returns the message when it cannot be routed to any queue
+// Returned messages are passed to the producer's return handler, in confirm mode their publish fails with ErrUnroutable
+// In confirm mode a mandatory message without a message ID is given a generated one
+func (o *PublishOptions) SetMandatory(mandatory bool) {
+	o.mandatory = mandatory
+}
+
+// SetImmediate sets whether the broker returns the message when it cannot be delivered to a consumer right away
+// RabbitMQ does not support the immediate flag and closes the channel when it is set
+func (o *PublishOptions) SetImmediate(immediate bool) {
+	o.immediate = immediate
+}
+
+// publishing creates the amqp publishing for a message body and headers using these options
+func (o *PublishOptions) publishing(msg []byte, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     o.contentType,
+		ContentEncoding: o.contentEncoding,
+		DeliveryMode:    o.deliveryMode,
+		Priority:        o.priority,
+		CorrelationId:   o.correlationID,
+		ReplyTo:         o.replyTo,
+		Expiration:      o.expiration,
+		MessageId:       o.messageID,
+		Timestamp:       time.Now(),
+		Type:            o.messageType,
+		UserId:          o.userID,
+		AppId:           o.appID,
+		Body:            msg,
+	}
+}
@@ -0,0 +1,106 @@
+package alice
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPublishing(t *testing.T) {
+	options := CreateDefaultPublishOptions()
+	options.SetDeliveryMode(amqp.Persistent)
+	options.SetContentType("application/json")
+	options.SetContentEncoding("gzip")
+	options.SetPriority(5)
+	options.SetExpiration(time.Millisecond * 1500)
+	options.SetMessageID("message")
+	options.SetCorrelationID("correlation")
+	options.SetReplyTo("replies")
+	options.SetType("order.created")
+	options.SetAppID("shop")
+	options.SetUserID("guest")
+
+	headers := amqp.Table{"tenant": "acme"}
+	publishing := options.publishing([]byte("body"), headers)
+
+	want := amqp.Publishing{
+		Headers:         headers,
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		Priority:        5,
+		CorrelationId:   "correlation",
+		ReplyTo:         "replies",
+		Expiration:      "1500",
+		MessageId:       "message",
+		Timestamp:       publishing.Timestamp,
+		Type:            "order.created",
+		UserId:          "guest",
+		AppId:           "shop",
+		Body:            []byte("body"),
+	}
+	if publishing.Timestamp.IsZero() {
+		t.Error("expected the publishing to be timestamped")
+	}
+	if !reflect.DeepEqual(publishing, want) {
+		t.Errorf("publishing = %+v, want %+v", publishing, want)
+	}
+}
+
+func TestPublishOptionsExpiration(t *testing.T) {
+	options := CreateDefaultPublishOptions()
+	if got := options.publishing(nil, nil).Expiration; got != "" {
+		t.Errorf("default expiration = %q, want none", got)
+	}
+
+	// Expirations are published in whole milliseconds
+	options.SetExpiration(time.Minute + time.Microsecond*1500)
+	if got := options.publishing(nil, nil).Expiration; got != "60001" {
+		t.Errorf("expiration = %q, want %q", got, "60001")
+	}
+
+	options.SetExpiration(0)
+	if got := options.publishing(nil, nil).Expiration; got != "" {
+		t.Errorf("cleared expiration = %q, want none", got)
+	}
+}
+
+func TestProducerPublishOptions(t *testing.T) {
+	defaults := CreateDefaultPublishOptions()
+	defaults.SetContentType("application/json")
+
+	config := CreateProducerConfig()
+	config.SetPublishOptions(defaults)
+
+	p := newTestProducer(t, config)
+
+	var published *Message
+	p.publishChain = func(ctx context.Context, message *Message) (*Confirmation, error) {
+		published = message
+		return nil, nil
+	}
+
+	// Publishes without options use the producer's defaults
+	p.Publish(context.Background(), []byte("default"), "key", nil)
+	if published.Options != defaults {
+		t.Errorf("options = %+v, want the producer defaults", published.Options)
+	}
+
+	// Options passed to the publish call override them
+	override := CreateDefaultPublishOptions()
+	override.SetContentType("text/csv")
+	p.PublishWithOptions(context.Background(), []byte("override"), "key", nil, override)
+	if published.Options != override {
+		t.Errorf("options = %+v, want the options of the publish call", published.Options)
+	}
+
+	// Setting nil options resets the defaults instead of failing the next publish
+	config.SetPublishOptions(nil)
+	p.Publish(context.Background(), []byte("reset"), "key", nil)
+	if got := published.Options.publishing(nil, nil).ContentType; got != "plaintext" {
+		t.Errorf("content type = %q, want the default %q", got, "plaintext")
+	}
+}
@@ -0,0 +1,130 @@
+package alice
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RetryCountHeader is the header holding the number of times a delivery has been retried
+const RetryCountHeader = "x-alice-retry-count"
+
+// RetryPolicy models how failed deliveries are redelivered after a delay and parked once they run out of attempts
+// Delays are implemented with a retry queue per delay, whose messages expire and are dead-lettered back to the consumer's queue
+type RetryPolicy struct {
+	maxAttempts  int           // Maximum number of deliveries, including the first one
+	initialDelay time.Duration // Delay before the first retry
+	multiplier   float64       // Factor the delay grows with every retry, 1 for a fixed delay
+	maxDelay     time.Duration // Upper bound of the delay, 0 means unbounded
+	parkingQueue string        // Name of the queue exhausted deliveries are routed to, defaults to "<queue>.parking"
+}
+
+// CreateFixedRetryPolicy creates a retry policy which waits the same delay before every retry
+//	maxAttempts: the maximum number of deliveries, including the first one
+func CreateFixedRetryPolicy(maxAttempts int, delay time.Duration) *RetryPolicy {
+	return CreateExponentialRetryPolicy(maxAttempts, delay, 1, 0)
+}
+
+// CreateExponentialRetryPolicy creates a retry policy whose delay is multiplied by multiplier after every retry, up to maxDelay (0 for no limit)
+//	maxAttempts: the maximum number of deliveries, including the first one
+func CreateExponentialRetryPolicy(maxAttempts int, initialDelay time.Duration, multiplier float64, maxDelay time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		maxAttempts:  maxAttempts,
+		initialDelay: initialDelay,
+		multiplier:   multiplier,
+		maxDelay:     maxDelay,
+	}
+}
+
+// SetParkingQueue sets the name of the queue deliveries are routed to once they are out of attempts
+func (r *RetryPolicy) SetParkingQueue(name string) {
+	r.parkingQueue = name
+}
+
+// delay returns the delay before the given retry, starting at 1
+// Delays are rounded to milliseconds, the resolution of message TTLs
+func (r *RetryPolicy) delay(retry int) time.Duration {
+	delay := float64(r.initialDelay)
+	for i := 1; i < retry; i++ {
+		delay *= r.multiplier
+		if r.maxDelay > 0 && delay >= float64(r.maxDelay) {
+			break
+		}
+	}
+
+	d := time.Duration(delay)
+	if r.maxDelay > 0 && d > r.maxDelay {
+		d = r.maxDelay
+	}
+	return d.Round(time.Millisecond)
+}
+
+// delays returns every distinct delay of this policy, one retry queue is needed per delay
+func (r *RetryPolicy) delays() []time.Duration {
+	delays := make([]time.Duration, 0, r.maxAttempts)
+	for retry := 1; retry < r.maxAttempts; retry++ {
+		d := r.delay(retry)
+		if len(delays) == 0 || delays[len(delays)-1] != d {
+			delays = append(delays, d)
+		}
+	}
+	return delays
+}
+
+// retryQueueName returns the name of the retry queue holding deliveries of queue for the given delay
+func retryQueueName(queue *Queue, delay time.Duration) string {
+	return queue.name + ".retry." + strconv.FormatInt(delay.Milliseconds(), 10)
+}
+
+// parkingQueueName returns the name of the queue exhausted deliveries of queue are routed to
+func (r *RetryPolicy) parkingQueueName(queue *Queue) string {
+	if r.parkingQueue != "" {
+		return r.parkingQueue
+	}
+	return queue.name + ".parking"
+}
+
+// retryCount returns the number of times a delivery has been retried
+func retryCount(delivery amqp.Delivery) int {
+	switch count := delivery.Headers[RetryCountHeader].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int16:
+		return int(count)
+	case int8:
+		return int(count)
+	case int:
+		return count
+	default:
+		return 0
+	}
+}
+
+// retryPublishing copies a delivery into a publishing carrying the given retry count
+func retryPublishing(delivery amqp.Delivery, retries int) amqp.Publishing {
+	headers := make(amqp.Table, len(delivery.Headers)+1)
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+	headers[RetryCountHeader] = int32(retries)
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		UserId:          delivery.UserId,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
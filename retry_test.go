@@ -0,0 +1,70 @@
+package alice
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRetryPolicyDelays(t *testing.T) {
+	fixed := CreateFixedRetryPolicy(4, time.Second)
+	if got := fixed.delays(); !reflect.DeepEqual(got, []time.Duration{time.Second}) {
+		t.Errorf("fixed policy delays = %v", got)
+	}
+
+	exponential := CreateExponentialRetryPolicy(6, time.Second, 2, time.Second*5)
+	want := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5}
+	if got := exponential.delays(); !reflect.DeepEqual(got, want) {
+		t.Errorf("exponential policy delays = %v, want %v", got, want)
+	}
+}
+
+func TestRetryQueueNames(t *testing.T) {
+	exchange, _ := CreateDefaultExchange("orders", Direct)
+	queue := CreateDefaultQueue(exchange, "orders")
+
+	if got := retryQueueName(queue, time.Millisecond*1500); got != "orders.retry.1500" {
+		t.Errorf("retry queue name = %s", got)
+	}
+
+	policy := CreateFixedRetryPolicy(3, time.Second)
+	if got := policy.parkingQueueName(queue); got != "orders.parking" {
+		t.Errorf("parking queue name = %s", got)
+	}
+
+	policy.SetParkingQueue("orders.dead")
+	if got := policy.parkingQueueName(queue); got != "orders.dead" {
+		t.Errorf("parking queue name = %s", got)
+	}
+}
+
+func TestRetryPublishing(t *testing.T) {
+	delivery := amqp.Delivery{
+		Headers: amqp.Table{"tenant": "acme", RetryCountHeader: int32(1)},
+		Body:    []byte("order"),
+	}
+
+	publishing := retryPublishing(delivery, retryCount(delivery)+1)
+	want := amqp.Table{"tenant": "acme", RetryCountHeader: int32(2)}
+	if !reflect.DeepEqual(publishing.Headers, want) {
+		t.Errorf("headers = %v, want %v", publishing.Headers, want)
+	}
+	if delivery.Headers[RetryCountHeader] != int32(1) {
+		t.Error("expected the delivery's headers to be left alone")
+	}
+}
+
+func TestRetryFallback(t *testing.T) {
+	if got := retryFallback(fmt.Errorf("%w: NO_ROUTE", ErrUnroutable)); got != Reject {
+		t.Errorf("unroutable retry disposition = %s, want %s", got, Reject)
+	}
+	if got := retryFallback(ErrNacked); got != Requeue {
+		t.Errorf("nacked retry disposition = %s, want %s", got, Requeue)
+	}
+	if got := retryFallback(ErrChannelClosed); got != Requeue {
+		t.Errorf("interrupted retry disposition = %s, want %s", got, Requeue)
+	}
+}
@@ -0,0 +1,94 @@
+package alice
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// A SpooledMessage is a message a producer holds on to until the broker has accepted it
+type SpooledMessage struct {
+	ID         uint64          // Assigned by the store, increasing in the order the messages were spooled
+	RoutingKey string          // The routing key to publish the message with
+	Publishing amqp.Publishing // The message body and properties
+	Mandatory  bool            // Whether to publish the message with the mandatory flag
+	Immediate  bool            // Whether to publish the message with the immediate flag
+	SpooledAt  time.Time       // When the message was spooled
+}
+
+// A SpoolStore stores the messages a producer spools during an outage, and in confirm mode until they are confirmed
+// The producer replays the spooled messages in order once its channel is (re-)opened, so a store must only be used by a single producer.
+// See CreateFileSpool for a store which survives restarts of the application.
+type SpoolStore interface {
+	// Append stores a message at the end of the spool, assigning its ID
+	// Returns ErrOutageBufferFull when the spool has reached its size limit
+	Append(message *SpooledMessage) error
+	// Remove deletes a message once the broker has accepted it, removing an unknown message is a no-op
+	Remove(id uint64) error
+	// Messages returns the spooled messages in the order they were appended
+	Messages() ([]*SpooledMessage, error)
+	// Len returns the number of spooled messages
+	Len() int
+	// Close releases the resources of the store, it is called when the producer is shut down
+	Close() error
+}
+
+// memorySpool is a SpoolStore keeping the messages in memory, it is used when no store is configured
+type memorySpool struct {
+	mu          sync.Mutex        // Guards the fields below
+	messages    []*SpooledMessage // The spooled messages, in order
+	lastID      uint64            // ID of the last appended message
+	maxMessages int               // Maximum number of spooled messages
+}
+
+// createMemorySpool creates an in-memory spool holding at most maxMessages messages
+func createMemorySpool(maxMessages int) *memorySpool {
+	return &memorySpool{maxMessages: maxMessages}
+}
+
+func (s *memorySpool) Append(message *SpooledMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.messages) >= s.maxMessages {
+		return ErrOutageBufferFull
+	}
+
+	s.lastID++
+	message.ID = s.lastID
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func (s *memorySpool) Remove(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, message := range s.messages {
+		if message.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memorySpool) Messages() ([]*SpooledMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]*SpooledMessage, len(s.messages))
+	copy(messages, s.messages)
+	return messages, nil
+}
+
+func (s *memorySpool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+func (s *memorySpool) Close() error {
+	return nil
+}
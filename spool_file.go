@@ -0,0 +1,434 @@
+package alice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func init() {
+	// The types header values can have besides the basic types gob knows about
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(amqp.Decimal{})
+}
+
+const (
+	spoolAppend byte = 1 // Record of an appended message
+	spoolRemove byte = 2 // Record of a removed message
+
+	spoolHeaderSize       = 8    // Size of the record header: payload length and CRC-32 checksum
+	spoolCompactThreshold = 1024 // Number of remove records after which the log is compacted
+)
+
+var (
+	// ErrSpoolClosed is returned when using a spool store which has been closed
+	ErrSpoolClosed = errors.New("spool is closed")
+
+	// ErrSpoolCorrupt is returned when opening a spool log with a corrupt record before its last record
+	ErrSpoolCorrupt = errors.New("spool log is corrupt")
+)
+
+// FileSpool is a SpoolStore keeping the messages in an append-only log file, so they survive restarts of the application
+// Only the positions of the messages in the log are kept in memory, the log is compacted as messages are removed
+type FileSpool struct {
+	path        string                 // Path of the log file
+	mu          sync.Mutex             // Guards the fields below
+	file        *os.File               // The log file, nil once closed
+	size        int64                  // Size of the log file
+	records     map[uint64]spoolRecord // The records of the spooled messages by ID
+	order       []uint64               // IDs of the spooled messages in order, may contain removed IDs
+	lastID      uint64                 // ID of the last appended message
+	bytes       int64                  // Total body size of the spooled messages
+	removed     int                    // Number of remove records in the log
+	maxMessages int                    // Maximum number of spooled messages, 0 means unlimited
+	maxBytes    int64                  // Maximum total body size of the spooled messages, 0 means unlimited
+	sync        bool                   // Whether every write is synced to disk
+}
+
+// spoolRecord is the position of an appended message in the log
+type spoolRecord struct {
+	offset   int64 // Offset of the record in the log
+	length   int64 // Length of the record, including its header
+	bodySize int64 // Size of the message body
+}
+
+/*
+CreateFileSpool opens the spool log at the given path, creating it if it does not exist
+Messages spooled by a previous run are replayed once the producer using the spool opens its channel
+A torn record at the end of the log, left by a crash during a write, is dropped
+	path: string, path of the log file
+	Returns the FileSpool and a possible error, ErrSpoolCorrupt if a record before the last one is corrupt, the log is left untouched then
+*/
+func CreateFileSpool(path string) (*FileSpool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileSpool{
+		path:    path,
+		file:    file,
+		records: make(map[uint64]spoolRecord),
+		sync:    true,
+	}
+
+	err = s.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Drop the removed messages from the log
+	if s.removed > 0 {
+		err = s.compact()
+		if err != nil {
+			s.file.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// SetMaxMessages sets the maximum number of spooled messages, 0 means unlimited
+func (s *FileSpool) SetMaxMessages(maxMessages int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxMessages = maxMessages
+}
+
+// SetMaxBytes sets the maximum total body size of the spooled messages, 0 means unlimited
+func (s *FileSpool) SetMaxBytes(maxBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxBytes = maxBytes
+}
+
+// SetSync sets whether every write is synced to disk before it returns, which is the default
+// Without syncing, spooled messages can be lost when the machine crashes, but not when only the application does
+func (s *FileSpool) SetSync(sync bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sync = sync
+}
+
+// Append writes a message to the end of the log, assigning its ID
+func (s *FileSpool) Append(message *SpooledMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return ErrSpoolClosed
+	}
+
+	bodySize := int64(len(message.Publishing.Body))
+	if (s.maxMessages > 0 && len(s.records) >= s.maxMessages) || (s.maxBytes > 0 && s.bytes+bodySize > s.maxBytes) {
+		return ErrOutageBufferFull
+	}
+
+	message.ID = s.lastID + 1
+
+	var payload bytes.Buffer
+	payload.WriteByte(spoolAppend)
+	err := gob.NewEncoder(&payload).Encode(message)
+	if err != nil {
+		return err
+	}
+
+	offset := s.size
+	length, err := s.write(payload.Bytes())
+	if err != nil {
+		return err
+	}
+
+	s.lastID = message.ID
+	s.records[message.ID] = spoolRecord{offset: offset, length: length, bodySize: bodySize}
+	s.order = append(s.order, message.ID)
+	s.bytes += bodySize
+	return nil
+}
+
+// Remove writes the removal of a message to the log, the log is compacted once enough messages have been removed
+func (s *FileSpool) Remove(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return ErrSpoolClosed
+	}
+
+	record, ok := s.records[id]
+	if !ok {
+		return nil
+	}
+
+	payload := make([]byte, 1+binary.MaxVarintLen64)
+	payload[0] = spoolRemove
+	n := binary.PutUvarint(payload[1:], id)
+	_, err := s.write(payload[:1+n])
+	if err != nil {
+		return err
+	}
+
+	delete(s.records, id)
+	s.bytes -= record.bodySize
+	s.removed++
+
+	if len(s.records) == 0 || (s.removed >= spoolCompactThreshold && s.removed > len(s.records)) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Messages reads the spooled messages from the log, in order
+func (s *FileSpool) Messages() ([]*SpooledMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil, ErrSpoolClosed
+	}
+
+	messages := make([]*SpooledMessage, 0, len(s.records))
+	for _, id := range s.order {
+		record, ok := s.records[id]
+		if !ok {
+			continue
+		}
+
+		message, err := s.read(record)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// Len returns the number of spooled messages
+func (s *FileSpool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+// Close closes the log file, the spooled messages are kept for the next run
+func (s *FileSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// write appends a record with the given payload to the log, returning the length of the record
+func (s *FileSpool) write(payload []byte) (int64, error) {
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolHeaderSize:], payload)
+
+	_, err := s.file.WriteAt(record, s.size)
+	if err != nil {
+		return 0, err
+	}
+	if s.sync {
+		err = s.file.Sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	s.size += int64(len(record))
+	return int64(len(record)), nil
+}
+
+// read reads the message of an append record from the log
+func (s *FileSpool) read(record spoolRecord) (*SpooledMessage, error) {
+	buf := make([]byte, record.length)
+	_, err := s.file.ReadAt(buf, record.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &SpooledMessage{}
+	err = gob.NewDecoder(bytes.NewReader(buf[spoolHeaderSize+1:])).Decode(message)
+	return message, err
+}
+
+// load replays the log to find the spooled messages
+// A torn record at the end of the log, left by a crash during a write, is truncated
+// Any other corrupt record fails the load, as truncating the log at it would drop the messages after it
+func (s *FileSpool) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := io.NewSectionReader(s.file, 0, info.Size())
+
+	var offset int64
+	header := make([]byte, spoolHeaderSize)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			break
+		}
+
+		// A corrupt length would otherwise allocate up to 4 GiB before the checksum is checked
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if length > info.Size()-offset-spoolHeaderSize {
+			break
+		}
+
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return err
+		}
+		if len(payload) == 0 || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			// Only the last record can have been torn by a crash
+			if offset+spoolHeaderSize+length == info.Size() {
+				break
+			}
+			return fmt.Errorf("%w: invalid record at offset %d", ErrSpoolCorrupt, offset)
+		}
+
+		length += spoolHeaderSize
+		switch payload[0] {
+		case spoolAppend:
+			message := &SpooledMessage{}
+			err = gob.NewDecoder(bytes.NewReader(payload[1:])).Decode(message)
+			if err != nil {
+				return err
+			}
+
+			bodySize := int64(len(message.Publishing.Body))
+			s.records[message.ID] = spoolRecord{offset: offset, length: length, bodySize: bodySize}
+			s.order = append(s.order, message.ID)
+			s.bytes += bodySize
+			if message.ID > s.lastID {
+				s.lastID = message.ID
+			}
+
+		case spoolRemove:
+			id, _ := binary.Uvarint(payload[1:])
+			if record, ok := s.records[id]; ok {
+				delete(s.records, id)
+				s.bytes -= record.bodySize
+			}
+			s.removed++
+		}
+
+		offset += length
+	}
+
+	s.size = offset
+	if offset < info.Size() {
+		return s.file.Truncate(offset)
+	}
+	return nil
+}
+
+// compact rewrites the log with only the spooled messages
+func (s *FileSpool) compact() error {
+	// Nothing is spooled, start over
+	if len(s.records) == 0 {
+		err := s.file.Truncate(0)
+		if err == nil && s.sync {
+			err = s.file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		s.size = 0
+		s.order = nil
+		s.removed = 0
+		return nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Copy the records of the spooled messages in order
+	records := make(map[uint64]spoolRecord, len(s.records))
+	order := make([]uint64, 0, len(s.records))
+	var offset int64
+	for _, id := range s.order {
+		record, ok := s.records[id]
+		if !ok {
+			continue
+		}
+
+		buf := make([]byte, record.length)
+		_, err = s.file.ReadAt(buf, record.offset)
+		if err == nil {
+			_, err = tmp.WriteAt(buf, offset)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+
+		records[id] = spoolRecord{offset: offset, length: record.length, bodySize: record.bodySize}
+		order = append(order, id)
+		offset += record.length
+	}
+
+	err = tmp.Sync()
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Make the rename durable, otherwise a crash can bring back the old log
+	if s.sync {
+		err = syncDir(filepath.Dir(s.path))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.size = offset
+	s.records = records
+	s.order = order
+	s.removed = 0
+	return nil
+}
+
+// syncDir syncs a directory, making the creation and renaming of the files in it durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
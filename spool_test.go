@@ -0,0 +1,298 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// createSpoolTestMessage creates a message to spool with the given body
+func createSpoolTestMessage(body string) *SpooledMessage {
+	return &SpooledMessage{
+		RoutingKey: "key",
+		Publishing: amqp.Publishing{
+			Headers: amqp.Table{"attempt": int64(1), "tags": []interface{}{"a", "b"}},
+			Body:    []byte(body),
+		},
+		Mandatory: true,
+	}
+}
+
+// spooledBodies returns the bodies of the spooled messages, in order
+func spooledBodies(t *testing.T, store SpoolStore) []string {
+	messages, err := store.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := make([]string, 0, len(messages))
+	for _, message := range messages {
+		bodies = append(bodies, string(message.Publishing.Body))
+	}
+	return bodies
+}
+
+func TestMemorySpool(t *testing.T) {
+	store := createMemorySpool(2)
+
+	first, second := createSpoolTestMessage("first"), createSpoolTestMessage("second")
+	store.Append(first)
+	store.Append(second)
+	if err := store.Append(createSpoolTestMessage("third")); err != ErrOutageBufferFull {
+		t.Errorf("err = %v, want %v", err, ErrOutageBufferFull)
+	}
+
+	store.Remove(first.ID)
+	if bodies := spooledBodies(t, store); !reflect.DeepEqual(bodies, []string{"second"}) {
+		t.Errorf("spooled %v, want [second]", bodies)
+	}
+}
+
+func TestFileSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.log")
+
+	store, err := CreateFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []*SpooledMessage{createSpoolTestMessage("first"), createSpoolTestMessage("second"), createSpoolTestMessage("third")}
+	for _, message := range messages {
+		if err := store.Append(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Remove(messages[1].ID)
+	store.Close()
+
+	// The spool survives a restart
+	store, err = CreateFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	spooled, err := store.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spooled) != 2 || !reflect.DeepEqual(spooled[0], messages[0]) || !reflect.DeepEqual(spooled[1], messages[2]) {
+		t.Fatalf("spooled %+v, want the first and third message", spooled)
+	}
+
+	// New messages are appended after the existing ones
+	fourth := createSpoolTestMessage("fourth")
+	store.Append(fourth)
+	if fourth.ID <= messages[2].ID {
+		t.Errorf("ID = %d, want more than %d", fourth.ID, messages[2].ID)
+	}
+
+	// Removing every message empties the log
+	store.Remove(messages[0].ID)
+	store.Remove(messages[2].ID)
+	store.Remove(fourth.ID)
+	if info, _ := os.Stat(path); store.Len() != 0 || info.Size() != 0 {
+		t.Errorf("spooled %d messages in %d bytes, want an empty log", store.Len(), info.Size())
+	}
+}
+
+func TestFileSpoolLimits(t *testing.T) {
+	store, err := CreateFileSpool(filepath.Join(t.TempDir(), "spool.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.SetMaxMessages(2)
+	store.SetMaxBytes(10)
+
+	if err := store.Append(createSpoolTestMessage("12345678")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(createSpoolTestMessage("123")); err != ErrOutageBufferFull {
+		t.Errorf("exceeding max bytes: err = %v, want %v", err, ErrOutageBufferFull)
+	}
+	if err := store.Append(createSpoolTestMessage("12")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(createSpoolTestMessage("")); err != ErrOutageBufferFull {
+		t.Errorf("exceeding max messages: err = %v, want %v", err, ErrOutageBufferFull)
+	}
+}
+
+func TestFileSpoolTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.log")
+
+	store, _ := CreateFileSpool(path)
+	store.Append(createSpoolTestMessage("first"))
+	store.Close()
+
+	// Simulate a crash halfway through writing a record
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte{0, 0, 1, 0, 42})
+	file.Close()
+
+	store, err := CreateFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.Append(createSpoolTestMessage("second"))
+	if bodies := spooledBodies(t, store); !reflect.DeepEqual(bodies, []string{"first", "second"}) {
+		t.Errorf("spooled %v, want [first second]", bodies)
+	}
+}
+
+func TestFileSpoolCorruptLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.log")
+
+	store, _ := CreateFileSpool(path)
+	store.Append(createSpoolTestMessage("first"))
+	store.Close()
+
+	// A record header claiming a length beyond the end of the log is truncated without reading it
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	file.Close()
+
+	store, err := CreateFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if bodies := spooledBodies(t, store); !reflect.DeepEqual(bodies, []string{"first"}) {
+		t.Errorf("spooled %v, want [first]", bodies)
+	}
+	if info, _ := os.Stat(path); info.Size() != store.size {
+		t.Errorf("log is %d bytes, want %d", info.Size(), store.size)
+	}
+}
+
+func TestFileSpoolCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.log")
+
+	store, _ := CreateFileSpool(path)
+	for _, body := range []string{"first", "second", "third"} {
+		store.Append(createSpoolTestMessage(body))
+	}
+	second := store.records[2]
+	store.Close()
+	info, _ := os.Stat(path)
+
+	// A corrupt record followed by valid ones was not torn by a crash, so the log is not truncated at it
+	file, _ := os.OpenFile(path, os.O_WRONLY, 0600)
+	file.WriteAt([]byte{0xff}, second.offset+second.length-1)
+	file.Close()
+
+	if _, err := CreateFileSpool(path); !errors.Is(err, ErrSpoolCorrupt) {
+		t.Errorf("err = %v, want %v", err, ErrSpoolCorrupt)
+	}
+	if corrupt, _ := os.Stat(path); corrupt.Size() != info.Size() {
+		t.Errorf("log is %d bytes, want %d", corrupt.Size(), info.Size())
+	}
+
+	// Once the records after it are gone, the corrupt record is truncated like a torn one
+	os.Truncate(path, second.offset+second.length)
+
+	store, err := CreateFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if bodies := spooledBodies(t, store); !reflect.DeepEqual(bodies, []string{"first"}) {
+		t.Errorf("spooled %v, want [first]", bodies)
+	}
+}
+
+func TestProducerSpool(t *testing.T) {
+	store, err := CreateFileSpool(filepath.Join(t.TempDir(), "spool.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateProducerConfig()
+	config.SetConfirmMode(true)
+	config.SetSpool(store)
+
+	p := newTestProducer(t, config)
+
+	// The producer has no channel yet, so the message is spooled
+	confirmation, err := p.PublishWithConfirmation([]byte("spooled"), "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spooled, _ := p.Spooled(); len(spooled) != 1 || string(spooled[0].Publishing.Body) != "spooled" {
+		t.Fatalf("spooled %+v, want the published message", spooled)
+	}
+	if h := p.health(); h.Buffered != 1 {
+		t.Errorf("health reports %d spooled messages, want 1", h.Buffered)
+	}
+
+	// Shutting down fails the publish, the store keeps the message for the next run
+	p.stop()
+	if err := confirmation.Wait(context.Background()); err != ErrChannelClosed {
+		t.Errorf("err = %v, want %v", err, ErrChannelClosed)
+	}
+	if store.Len() != 1 {
+		t.Errorf("store holds %d messages, want 1", store.Len())
+	}
+}
+
+func TestProducerSpoolInvalidHeaders(t *testing.T) {
+	store, err := CreateFileSpool(filepath.Join(t.TempDir(), "spool.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := CreateProducerConfig()
+	config.SetConfirmMode(true)
+	config.SetSpool(store)
+
+	p := newTestProducer(t, config)
+	invalid := amqp.Table{"count": uint32(1)}
+
+	// A message the broker would never accept is not spooled
+	if _, err := p.PublishWithConfirmation([]byte("invalid"), "key", invalid); err == nil {
+		t.Error("expected publishing a message with an unsupported header type to fail")
+	}
+	if store.Len() != 0 {
+		t.Fatalf("store holds %d messages, want 0", store.Len())
+	}
+
+	// A message which got into the spool anyway is dropped on replay instead of holding up the spool
+	message := &SpooledMessage{RoutingKey: "key", Publishing: amqp.Publishing{Headers: invalid, Body: []byte("invalid")}}
+	if err := store.Append(message); err != nil {
+		t.Fatal(err)
+	}
+	confirmation := newConfirmation(0)
+	p.spooled[message.ID] = &spooledConfirmation{confirmation: confirmation}
+
+	p.publishMutex.Lock()
+	p.channel = &amqp.Channel{}
+	p.confirms = newConfirmTracker(func(*Confirmation) {})
+	p.available = true
+	p.replaySpool()
+	replayed := p.replayed
+	p.publishMutex.Unlock()
+
+	if !replayed {
+		t.Error("expected the spool to be replayed")
+	}
+	if store.Len() != 0 {
+		t.Errorf("store holds %d messages, want 0", store.Len())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := confirmation.Wait(ctx); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("err = %v, want the publish error", err)
+	}
+	p.closeSpool()
+}
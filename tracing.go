@@ -0,0 +1,126 @@
+package alice
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+// SpanKind is the role of a span in a messaging flow, the values match the OpenTelemetry span kinds
+type SpanKind int
+
+const (
+	// SpanKindProducer is the kind of the spans started when publishing a message
+	SpanKindProducer SpanKind = 4
+	// SpanKindConsumer is the kind of the spans started when handling a delivered message
+	SpanKindConsumer SpanKind = 5
+)
+
+// A Span is a traced operation started by a Tracer
+type Span interface {
+	// RecordError marks the span as failed with the given error
+	RecordError(err error)
+	// End completes the span
+	End()
+}
+
+// A Tracer starts the spans of published and consumed messages and propagates their trace context through the message headers
+// Its shape follows the OpenTelemetry tracing API, see the otel subpackage for an OpenTelemetry implementation
+type Tracer interface {
+	// Start starts a span as a child of the span carried by ctx, returning a context carrying the new span
+	Start(ctx context.Context, name string, kind SpanKind, attributes map[string]string) (context.Context, Span)
+	// Inject writes the trace context carried by ctx into the carrier, e.g. as W3C traceparent and tracestate headers
+	Inject(ctx context.Context, carrier HeaderCarrier)
+	// Extract reads the trace context from the carrier, returning a context carrying it as the remote parent
+	Extract(ctx context.Context, carrier HeaderCarrier) context.Context
+}
+
+// HeaderCarrier adapts AMQP message headers to carry trace context
+// It implements the OpenTelemetry TextMapCarrier interface
+type HeaderCarrier amqp.Table
+
+// Get returns the string value of the header with the given key, empty if it is not set or not a string
+func (c HeaderCarrier) Get(key string) string {
+	switch value := c[key].(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	default:
+		return ""
+	}
+}
+
+// Set sets the header with the given key
+func (c HeaderCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+// Keys returns the keys of the headers
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// nopTracer is a Tracer which neither starts spans nor propagates trace context
+type nopTracer struct{}
+
+// nopSpan is the span of a nopTracer
+type nopSpan struct{}
+
+func (nopTracer) Start(ctx context.Context, name string, kind SpanKind, attributes map[string]string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (nopTracer) Inject(ctx context.Context, carrier HeaderCarrier) {}
+
+func (nopTracer) Extract(ctx context.Context, carrier HeaderCarrier) context.Context {
+	return ctx
+}
+
+func (nopSpan) RecordError(err error) {}
+
+func (nopSpan) End() {}
+
+// startPublishSpan starts the span of a published message and injects its trace context into a copy of the headers
+// Returns the context carrying the span, the span and the headers to publish with
+func startPublishSpan(ctx context.Context, tracer Tracer, exchange string, key string, headers amqp.Table) (context.Context, Span, amqp.Table) {
+	// Without tracing there is nothing to inject
+	if _, ok := tracer.(nopTracer); ok {
+		return ctx, nopSpan{}, headers
+	}
+
+	ctx, span := tracer.Start(ctx, exchange+" publish", SpanKindProducer, map[string]string{
+		"messaging.system":                           "rabbitmq",
+		"messaging.operation":                        "publish",
+		"messaging.destination.name":                 exchange,
+		"messaging.rabbitmq.destination.routing_key": key,
+	})
+
+	// Copy the headers, the caller's table must not change
+	carrier := make(HeaderCarrier, len(headers)+2)
+	for k, v := range headers {
+		carrier[k] = v
+	}
+	tracer.Inject(ctx, carrier)
+
+	return ctx, span, amqp.Table(carrier)
+}
+
+// startDeliverySpan extracts the trace context of a delivery and starts the span of handling it
+// Returns the context carrying the span and the span
+func startDeliverySpan(tracer Tracer, queue string, consumerTag string, delivery amqp.Delivery) (context.Context, Span) {
+	ctx := tracer.Extract(context.Background(), HeaderCarrier(delivery.Headers))
+
+	return tracer.Start(ctx, queue+" process", SpanKindConsumer, map[string]string{
+		"messaging.system":                           "rabbitmq",
+		"messaging.operation":                        "process",
+		"messaging.source.name":                      queue,
+		"messaging.rabbitmq.destination.routing_key": delivery.RoutingKey,
+		"messaging.message.id":                       delivery.MessageId,
+		"messaging.consumer.id":                      consumerTag,
+	})
+}
@@ -0,0 +1,89 @@
+package alice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// spanKey is the context key of the spans started by fakeTracer
+type spanKey struct{}
+
+// fakeTracer propagates the name of the current span in a traceparent header
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	name   string
+	parent string
+	err    error
+	ended  bool
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, kind SpanKind, attributes map[string]string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	span := &fakeSpan{name: name, parent: parent}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, name), span
+}
+
+func (t *fakeTracer) Inject(ctx context.Context, carrier HeaderCarrier) {
+	if name, ok := ctx.Value(spanKey{}).(string); ok {
+		carrier.Set("traceparent", name)
+	}
+}
+
+func (t *fakeTracer) Extract(ctx context.Context, carrier HeaderCarrier) context.Context {
+	if name := carrier.Get("traceparent"); name != "" {
+		return context.WithValue(ctx, spanKey{}, name)
+	}
+	return ctx
+}
+
+func (s *fakeSpan) RecordError(err error) { s.err = err }
+
+func (s *fakeSpan) End() { s.ended = true }
+
+func TestTracePropagation(t *testing.T) {
+	tracer := &fakeTracer{}
+	headers := amqp.Table{"tenant": "acme"}
+
+	_, span, published := startPublishSpan(context.Background(), tracer, "orders", "created", headers)
+	span.End()
+
+	if _, ok := headers["traceparent"]; ok {
+		t.Error("expected the caller's headers to be left untouched")
+	}
+	if published["traceparent"] != "orders publish" || published["tenant"] != "acme" {
+		t.Errorf("published headers = %v", published)
+	}
+
+	config := CreateConfig("guest", "guest", "localhost", 5672, false, 0)
+	config.SetTracer(tracer)
+	consumer := &RabbitConsumer{
+		queue:  &Queue{name: "orders-queue"},
+		conn:   newTestConnection(config),
+		config: DefaultConsumerConfig,
+	}
+
+	var handlerSpan string
+	disposition := consumer.callHandler(func(ctx context.Context, delivery amqp.Delivery) error {
+		handlerSpan, _ = ctx.Value(spanKey{}).(string)
+		return errors.New("out of stock")
+	}, amqp.Delivery{Headers: published})
+
+	if handlerSpan != "orders-queue process" {
+		t.Errorf("handler span = %q, want %q", handlerSpan, "orders-queue process")
+	}
+	if disposition != Nack {
+		t.Errorf("disposition = %s, want nack", disposition)
+	}
+
+	consumeSpan := tracer.spans[1]
+	if consumeSpan.parent != "orders publish" || !consumeSpan.ended || consumeSpan.err == nil {
+		t.Errorf("consumer span = %+v, want an ended, failed child of the publish span", consumeSpan)
+	}
+}